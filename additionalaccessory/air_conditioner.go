@@ -1,8 +1,12 @@
 package additionalaccessory
 
 import (
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
+	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
@@ -17,10 +21,26 @@ type AirConditioner struct {
 	HeaterCooler *service.HeaterCooler
 }
 
-func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices []*natureremo.Device) AirConditioner {
+// エアコンのアクセサリーの設定
+type AirConditionerOptions struct {
+	// 室温として使う温度計のデバイス ID (複数の場合は平均、空の場合は自動で選ぶ)
+	TemperatureSensors []string
+	// デバイス ID ごとのセンサーの値の補正
+	Calibrations *Calibrations
+}
+
+// エアコンのアクセサリーを作る関数
+// (設定可能なモード・温度などが取れない場合はエラーを返し、他のアクセサリーには影響させない)
+func NewAirConditioner(log *logrus.Entry, nr util.NatureClient, ac *natureremo.Appliance, devices []*natureremo.Device, opts AirConditionerOptions) (AirConditioner, error) {
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	switch {
+	case ac.Model == nil:
+		return AirConditioner{}, fmt.Errorf("%s: %w: aircon model is unknown", ac.Nickname, ErrUnsupported)
+	case ac.AirCon == nil || ac.AirConSettings == nil:
+		return AirConditioner{}, fmt.Errorf("%s: %w: aircon settings are unknown", ac.Nickname, ErrUnsupported)
+	case ac.Device == nil:
+		return AirConditioner{}, fmt.Errorf("%s: %w: remo device is unknown", ac.Nickname, ErrUnsupported)
+	}
 
 	acceInfo := accessory.Info{
 		Name:         ac.Nickname,
@@ -41,12 +61,12 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 	}
 
 	// 現在の動作モードを呼び出された時の処理
-	a.HeaterCooler.TargetHeaterCoolerState.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+	a.HeaterCooler.TargetHeaterCoolerState.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 		log.Debug("Get now AirConditioner Mode Request")
-		aps := util.GetAppliances(nr)
+		aps := util.GetAppliances(util.RequestContext(r), nr)
 		for _, ap := range aps.Appliances {
-			if ap.ID == ac.ID {
-				switch ac.AirConSettings.OperationMode {
+			if ap.ID == ac.ID && ap.AirConSettings != nil {
+				switch ap.AirConSettings.OperationMode {
 				case natureremo.OperationModeCool:
 					return characteristic.TargetHeaterCoolerStateCool, 0
 				case natureremo.OperationModeWarm:
@@ -54,14 +74,14 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 				}
 			}
 		}
-		return nil, -1
+		return nil, hap.JsonStatusServiceCommunicationFailure
 	}
-	a.HeaterCooler.CurrentHeaterCoolerState.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+	a.HeaterCooler.CurrentHeaterCoolerState.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 		log.Debug("Get now AirConditioner Mode Request")
-		aps := util.GetAppliances(nr)
+		aps := util.GetAppliances(util.RequestContext(r), nr)
 		for _, ap := range aps.Appliances {
-			if ap.ID == ac.ID {
-				switch ac.AirConSettings.OperationMode {
+			if ap.ID == ac.ID && ap.AirConSettings != nil {
+				switch ap.AirConSettings.OperationMode {
 				case natureremo.OperationModeCool:
 					return characteristic.CurrentHeaterCoolerStateCooling, 0
 				case natureremo.OperationModeWarm:
@@ -75,11 +95,29 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 				}
 			}
 		}
-		return nil, -1
+		return nil, hap.JsonStatusServiceCommunicationFailure
+	}
+
+	// 電源の状態を呼び出された時の処理
+	a.HeaterCooler.Active.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+		log.Debug("Get now AirConditioner Active Request")
+		aps := util.GetAppliances(util.RequestContext(r), nr)
+		for _, ap := range aps.Appliances {
+			if ap.ID == ac.ID && ap.AirConSettings != nil {
+				if ap.AirConSettings.Button == natureremo.ButtonPowerOff {
+					return characteristic.ActiveInactive, 0
+				}
+				return characteristic.ActiveActive, 0
+			}
+		}
+		return nil, hap.JsonStatusServiceCommunicationFailure
 	}
 
 	// 動作モードが変わった時の処理
-	a.HeaterCooler.TargetHeaterCoolerState.OnValueRemoteUpdate(func(target int) {
+	a.HeaterCooler.TargetHeaterCoolerState.OnValueUpdate(func(target, _ int, r *http.Request) {
+		if r == nil {
+			return
+		}
 		log.Infof("AirConditioner TargetHeaterCoolerState Changed: %d", target)
 		req := natureremo.AirConSettings{}
 		switch target {
@@ -90,18 +128,21 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 		case characteristic.TargetHeatingCoolingStateOff:
 			req.Button = natureremo.ButtonPowerOff
 		}
-		if err := util.SendAirconRequest(nr, ac, &req); err != nil {
+		if err := util.SendAirconRequest(r.Context(), nr, ac, &req); err != nil {
 			log.Error(err)
 		}
 	})
 
-	a.HeaterCooler.Active.OnValueRemoteUpdate(func(target int) {
+	a.HeaterCooler.Active.OnValueUpdate(func(target, _ int, r *http.Request) {
+		if r == nil {
+			return
+		}
 		log.Infof("AirConditioner Active Changed: %d", target)
 		req := natureremo.AirConSettings{}
 		if target == characteristic.ActiveInactive {
 			req.Button = natureremo.ButtonPowerOff
 		}
-		if err := util.SendAirconRequest(nr, ac, &req); err != nil {
+		if err := util.SendAirconRequest(r.Context(), nr, ac, &req); err != nil {
 			log.Error(err)
 		}
 	})
@@ -115,42 +156,35 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 		log.Infof("Cooler detected: %s", ac.Nickname)
 		targetState = append(targetState, characteristic.TargetHeaterCoolerStateCool)
 		currentState = append(currentState, characteristic.CurrentHeaterCoolerStateCooling)
-		threshold := *additionalcharacteristic.NewCoolingThresholdTemperature(cooler, nr, ac)
+		threshold, err := additionalcharacteristic.NewCoolingThresholdTemperature(log, cooler, nr, ac)
+		if err != nil {
+			return AirConditioner{}, fmt.Errorf("%s: %w", ac.Nickname, err)
+		}
 		a.HeaterCooler.AddC(threshold.C)
 	}
 	if heater, heaterFound := ac.AirCon.Range.Modes[natureremo.OperationModeWarm]; heaterFound {
 		log.Infof("Heater detected: %s", ac.Nickname)
 		targetState = append(targetState, characteristic.TargetHeaterCoolerStateHeat)
 		currentState = append(currentState, characteristic.CurrentHeaterCoolerStateHeating)
-		threshold := *additionalcharacteristic.NewHeatingThresholdTemperature(heater, nr, ac)
+		threshold, err := additionalcharacteristic.NewHeatingThresholdTemperature(log, heater, nr, ac)
+		if err != nil {
+			return AirConditioner{}, fmt.Errorf("%s: %w", ac.Nickname, err)
+		}
 		a.HeaterCooler.AddC(threshold.C)
 	}
 
+	if len(targetState) == 0 {
+		return AirConditioner{}, fmt.Errorf("%s: %w: neither cool nor warm mode is available", ac.Nickname, ErrUnsupported)
+	}
 	a.HeaterCooler.TargetHeaterCoolerState.ValidVals = targetState
 	a.HeaterCooler.CurrentHeaterCoolerState.ValidVals = currentState
 
 	// 現在の動作状況確認を初期状態で入れる処理(室温)
-	var temp float64
-	for _, device := range devices {
-		if val, found := device.NewestEvents[natureremo.SensorTypeTemperature]; found {
-			if device.ID == ac.Device.ID {
-				temp = val.Value
-				a.HeaterCooler.CurrentTemperature.SetValue(temp)
-			}
-		}
-	}
-
-	// Natureデバイスが温度計を持っていないものだった場合、別の端末で計測したものがあったら代わりに使う
-	if temp == 0 {
-		for _, device := range devices {
-			if temp == 0 {
-				if val, found := device.NewestEvents[natureremo.SensorTypeTemperature]; found {
-					log.Warnf("%s don't have temperature sensor. Using %s sensor instead for %s", ac.Device.Name, device.Name, ac.Nickname)
-					temp = val.Value
-					a.HeaterCooler.CurrentTemperature.SetValue(temp)
-				}
-			}
+	if temp, source, found := roomTemperature(ac, devices, opts); found {
+		if source != ac.Device.Name && len(opts.TemperatureSensors) == 0 {
+			log.Warnf("%s don't have temperature sensor. Using %s sensor instead for %s", ac.Device.Name, source, ac.Nickname)
 		}
+		a.HeaterCooler.CurrentTemperature.SetValue(temp)
 	}
 
 	// 現在の動作状況確認を初期状態で入れる処理(モード)
@@ -174,32 +208,63 @@ func NewAirConditioner(nr *natureremo.Client, ac *natureremo.Appliance, devices
 	}
 
 	// 現在気温の確認処理
-	a.HeaterCooler.CurrentTemperature.ValueRequestFunc = func(*http.Request) (interface{}, int) {
-		var temp float64
-		devices := util.GetDevices(nr)
-		for _, device := range devices.Devices {
-			if val, found := device.NewestEvents[natureremo.SensorTypeTemperature]; found {
-				if device.ID == ac.Device.ID {
-					temp = val.Value
-					log.Infof("%s: Get now AirCon Temperature Request Successful: %.1f", ac.Nickname, temp)
-					return temp, 0
-				}
-			}
+	a.HeaterCooler.CurrentTemperature.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+		devices := util.GetDevices(util.RequestContext(r), nr)
+		if temp, source, found := roomTemperature(ac, devices.Devices, opts); found {
+			log.Infof("%s: Get now AirCon Temperature Request Successful(%s): %.1f", ac.Nickname, source, temp)
+			return temp, 0
 		}
+		log.Warnf("%s: Get now AirCon Temperature Request devices was not found(%s)", ac.Nickname, ac.Device.Name)
+		return nil, hap.JsonStatusServiceCommunicationFailure
+	}
 
-		if temp == 0 {
-			for _, device := range devices.Devices {
-				if val, found := device.NewestEvents[natureremo.SensorTypeTemperature]; found {
-					temp = val.Value
-					log.Infof("%s: Get now AirCon Temperature Request Successful(%s): %.1f", ac.Nickname, device.Name, temp)
-					return temp, 0
-				}
+	addFaultStatus(log, a.A, a.HeaterCooler.S, ac.Nickname, applianceFault(ac))
+	a.AddS(a.HeaterCooler.S)
+	return a, nil
+}
+
+// エアコンの室温として使う温度(補正後)と、計測したデバイス名を返す関数
+// TemperatureSensors を指定した場合は、そのうち温度が取れたデバイスの平均を使う
+// 指定しない場合は家電を登録している Remo の温度計を使い、温度計がなければ温度計のある別の Remo で代用する
+func roomTemperature(ac *natureremo.Appliance, devices []*natureremo.Device, opts AirConditionerOptions) (float64, string, bool) {
+	temperature := func(device *natureremo.Device) (float64, bool) {
+		val, found := device.NewestEvents[natureremo.SensorTypeTemperature]
+		if !found {
+			return 0, false
+		}
+		return opts.Calibrations.Get(device.ID).Apply(natureremo.SensorTypeTemperature, val.Value), true
+	}
+
+	if len(opts.TemperatureSensors) != 0 {
+		var sum float64
+		var names []string
+		for _, device := range devices {
+			if !slices.Contains(opts.TemperatureSensors, device.ID) {
+				continue
+			}
+			if temp, found := temperature(device); found {
+				sum += temp
+				names = append(names, device.Name)
 			}
 		}
-		log.Warnf("%s: Get now AirCon Temperature Request devices was not found(%s)", ac.Nickname, ac.Device.Name)
-		return nil, -1
+		if len(names) == 0 {
+			return 0, "", false
+		}
+		return sum / float64(len(names)), strings.Join(names, ", "), true
 	}
 
-	a.AddS(a.HeaterCooler.S)
-	return a
+	for _, device := range devices {
+		if device.ID != ac.Device.ID {
+			continue
+		}
+		if temp, found := temperature(device); found {
+			return temp, device.Name, true
+		}
+	}
+	for _, device := range devices {
+		if temp, found := temperature(device); found {
+			return temp, device.Name, true
+		}
+	}
+	return 0, "", false
 }
@@ -0,0 +1,210 @@
+package additionalaccessory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestNewAirConditionerMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings natureremo.AirConSettings
+		active   int
+		current  int
+		target   int
+	}{
+		{"cool", natureremo.AirConSettings{OperationMode: natureremo.OperationModeCool}, characteristic.ActiveActive, characteristic.CurrentHeaterCoolerStateCooling, characteristic.TargetHeaterCoolerStateCool},
+		{"warm", natureremo.AirConSettings{OperationMode: natureremo.OperationModeWarm}, characteristic.ActiveActive, characteristic.CurrentHeaterCoolerStateHeating, characteristic.TargetHeaterCoolerStateHeat},
+		{"dry", natureremo.AirConSettings{OperationMode: natureremo.OperationModeDry}, characteristic.ActiveActive, characteristic.CurrentHeaterCoolerStateIdle, characteristic.TargetHeaterCoolerStateCool},
+		{"power off", natureremo.AirConSettings{OperationMode: natureremo.OperationModeWarm, Button: natureremo.ButtonPowerOff}, characteristic.ActiveInactive, characteristic.CurrentHeaterCoolerStateInactive, characteristic.TargetHeaterCoolerStateHeat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			device := newDevice("remo", "Remo", nil, time.Now())
+			ac := newAirCon(device, tt.settings)
+			nr := naturefake.NewClient([]*natureremo.Device{device}, []*natureremo.Appliance{ac})
+
+			a, err := NewAirConditioner(log, nr, ac, nr.Devices, AirConditionerOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			hc := a.HeaterCooler
+			if got := hc.Active.Value(); got != tt.active {
+				t.Errorf("Active = %d, want %d", got, tt.active)
+			}
+			if got, code := hc.Active.ValueRequest(request()); got != tt.active || code != 0 {
+				t.Errorf("Active.ValueRequest = %v(%d), want %d", got, code, tt.active)
+			}
+			if got := hc.CurrentHeaterCoolerState.Value(); got != tt.current {
+				t.Errorf("CurrentHeaterCoolerState = %d, want %d", got, tt.current)
+			}
+			if got := hc.TargetHeaterCoolerState.Value(); got != tt.target {
+				t.Errorf("TargetHeaterCoolerState = %d, want %d", got, tt.target)
+			}
+		})
+	}
+}
+
+func TestNewAirConditionerUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(ac *natureremo.Appliance)
+	}{
+		{"no model", func(ac *natureremo.Appliance) { ac.Model = nil }},
+		{"no settings", func(ac *natureremo.Appliance) { ac.AirConSettings = nil }},
+		{"no device", func(ac *natureremo.Appliance) { ac.Device = nil }},
+		{"blow only", func(ac *natureremo.Appliance) {
+			ac.AirCon.Range.Modes = map[natureremo.OperationMode]*natureremo.AirConRangeMode{
+				natureremo.OperationModeBlow: {},
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			device := newDevice("remo", "Remo", nil, time.Now())
+			ac := newAirCon(device, natureremo.AirConSettings{})
+			tt.modify(ac)
+			nr := naturefake.NewClient([]*natureremo.Device{device}, []*natureremo.Appliance{ac})
+
+			if _, err := NewAirConditioner(log, nr, ac, nr.Devices, AirConditionerOptions{}); !errors.Is(err, ErrUnsupported) {
+				t.Errorf("err = %v, want ErrUnsupported", err)
+			}
+		})
+	}
+}
+
+func TestAirConditionerTargetHeaterCoolerState(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial natureremo.OperationMode
+		target  int
+		mode    natureremo.OperationMode
+		current int
+	}{
+		{"to cool", natureremo.OperationModeWarm, characteristic.TargetHeaterCoolerStateCool, natureremo.OperationModeCool, characteristic.CurrentHeaterCoolerStateCooling},
+		{"to heat", natureremo.OperationModeCool, characteristic.TargetHeaterCoolerStateHeat, natureremo.OperationModeWarm, characteristic.CurrentHeaterCoolerStateHeating},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			device := newDevice("remo", "Remo", nil, time.Now())
+			ac := newAirCon(device, natureremo.AirConSettings{OperationMode: tt.initial, Temperature: "25"})
+			nr := naturefake.NewClient([]*natureremo.Device{device}, []*natureremo.Appliance{ac})
+
+			a, err := NewAirConditioner(log, nr, ac, nr.Devices, AirConditionerOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			hc := a.HeaterCooler
+			if _, status := hc.TargetHeaterCoolerState.SetValueRequest(tt.target, request()); status != 0 {
+				t.Fatalf("status = %d", status)
+			}
+
+			cmds := nr.Commands()
+			if len(cmds) != 1 || cmds[0].AirConSettings == nil {
+				t.Fatalf("commands = %+v, want 1 AirConSettings", cmds)
+			}
+			if got := cmds[0].AirConSettings.OperationMode; got != tt.mode {
+				t.Errorf("OperationMode = %q, want %q", got, tt.mode)
+			}
+			// 送信前に渡した家電の設定は書き換わらない
+			if ac.AirConSettings.OperationMode != tt.initial {
+				t.Errorf("original settings were modified: %q", ac.AirConSettings.OperationMode)
+			}
+
+			// 取得し直した家電の設定からモードを返す
+			if v, status := hc.TargetHeaterCoolerState.ValueRequest(request()); status != 0 || v != tt.target {
+				t.Errorf("TargetHeaterCoolerState = %v(%d), want %d", v, status, tt.target)
+			}
+			if v, status := hc.CurrentHeaterCoolerState.ValueRequest(request()); status != 0 || v != tt.current {
+				t.Errorf("CurrentHeaterCoolerState = %v(%d), want %d", v, status, tt.current)
+			}
+		})
+	}
+}
+
+func TestAirConditionerCurrentTemperature(t *testing.T) {
+	now := time.Now()
+	own := newDevice("remo", "Remo", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 24}, now)
+	noSensor := newDevice("remo", "Remo", nil, now)
+	other := newDevice("other", "Other", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 20}, now)
+	third := newDevice("third", "Third", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 23}, now)
+
+	tests := []struct {
+		name    string
+		devices []*natureremo.Device
+		opts    AirConditionerOptions
+		want    float64
+		found   bool
+	}{
+		{"own sensor", []*natureremo.Device{other, own}, AirConditionerOptions{}, 24, true},
+		{"fallback to other remo", []*natureremo.Device{noSensor, other}, AirConditionerOptions{}, 20, true},
+		{"average of sensors", []*natureremo.Device{own, other, third}, AirConditionerOptions{TemperatureSensors: []string{"other", "third"}}, 21.5, true},
+		{"calibrated", []*natureremo.Device{own}, AirConditionerOptions{Calibrations: NewCalibrations(map[string]SensorCalibration{"remo": {Temperature: Calibration{Offset: -1.5}}})}, 22.5, true},
+		{"no sensor", []*natureremo.Device{noSensor}, AirConditionerOptions{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			ac := newAirCon(own, natureremo.AirConSettings{OperationMode: natureremo.OperationModeCool})
+			nr := naturefake.NewClient(tt.devices, []*natureremo.Appliance{ac})
+
+			a, err := NewAirConditioner(log, nr, ac, tt.devices, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, status := a.HeaterCooler.CurrentTemperature.ValueRequest(request())
+			if !tt.found {
+				if status == 0 {
+					t.Errorf("CurrentTemperature = %v, want failure", v)
+				}
+				return
+			}
+			if status != 0 || v != tt.want {
+				t.Errorf("CurrentTemperature = %v(%d), want %g", v, status, tt.want)
+			}
+			if got := a.HeaterCooler.CurrentTemperature.Value(); got != tt.want {
+				t.Errorf("initial CurrentTemperature = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+// TemperatureSensors を指定した場合は、温度が取れたデバイスだけで平均し、他の Remo では代用しない
+func TestRoomTemperature(t *testing.T) {
+	now := time.Now()
+	own := newDevice("remo", "Remo", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 24}, now)
+	mini := newDevice("mini", "Mini", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 21}, now)
+	bedroom := newDevice("bedroom", "Bedroom", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 22, natureremo.SensorTypeHumidity: 50}, now)
+	noSensor := newDevice("nano", "Nano", nil, now)
+	ac := newAirCon(own, natureremo.AirConSettings{})
+	devices := []*natureremo.Device{own, mini, bedroom, noSensor}
+
+	tests := []struct {
+		name     string
+		sensors  []string
+		want     float64
+		wantName string
+		found    bool
+	}{
+		{name: "own sensor", want: 24, wantName: "Remo", found: true},
+		{name: "average in device order", sensors: []string{"bedroom", "mini"}, want: 21.5, wantName: "Mini, Bedroom", found: true},
+		{name: "skip device without thermometer", sensors: []string{"nano", "bedroom"}, want: 22, wantName: "Bedroom", found: true},
+		{name: "no listed device has thermometer", sensors: []string{"nano", "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, name, found := roomTemperature(ac, devices, AirConditionerOptions{TemperatureSensors: tt.sensors})
+			if found != tt.found || got != tt.want || name != tt.wantName {
+				t.Errorf("roomTemperature = %g, %q, %t, want %g, %q, %t", got, name, found, tt.want, tt.wantName, tt.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package additionalaccessory
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// 照度センサーの値を変換しない場合の最大値
+const maxIlluminationValue = 200
+
+// 温度・湿度の値の補正(値 * Scale + Offset)
+type Calibration struct {
+	Offset float64
+	// 倍率(0 の場合は 1)
+	Scale float64
+}
+
+func (c Calibration) apply(v float64) float64 {
+	scale := c.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return v*scale + c.Offset
+}
+
+// 照度センサーの値と、それに対応する lux
+type LuxPoint struct {
+	Value float64
+	Lux   float64
+}
+
+// Remo デバイスのセンサーの値の補正
+type SensorCalibration struct {
+	Temperature Calibration
+	Humidity    Calibration
+	// 照度センサーの値(0-200)から lux への変換表(値の昇順。間は線形補間し、範囲外は端の lux にする)
+	// 空の場合は値をそのまま lux として扱う
+	Illuminance []LuxPoint
+}
+
+// 照度の変換表の書き方が正しいかを確認する関数
+func (c SensorCalibration) Validate() error {
+	if len(c.Illuminance) == 1 {
+		return fmt.Errorf("illuminance needs at least 2 points")
+	}
+	for i, p := range c.Illuminance {
+		if p.Lux < 0 {
+			return fmt.Errorf("illuminance[%d].lux(%g) must not be negative", i, p.Lux)
+		}
+		if i > 0 && p.Value <= c.Illuminance[i-1].Value {
+			return fmt.Errorf("illuminance[%d].value(%g) must be greater than the previous value", i, p.Value)
+		}
+	}
+	if len(c.Illuminance) != 0 && c.maxLux() == 0 {
+		return fmt.Errorf("illuminance needs a point with positive lux")
+	}
+	return nil
+}
+
+// センサーの値を補正する関数
+func (c SensorCalibration) Apply(st natureremo.SensorType, v float64) float64 {
+	switch st {
+	case natureremo.SensorTypeTemperature:
+		return c.Temperature.apply(v)
+	case natureremo.SensorTypeHumidity:
+		return min(max(c.Humidity.apply(v), 0), 100)
+	case natureremo.SensorTypeIllumination:
+		return c.lux(v)
+	}
+	return v
+}
+
+func (c SensorCalibration) lux(v float64) float64 {
+	points := c.Illuminance
+	if len(points) == 0 {
+		return v
+	}
+	if v <= points[0].Value {
+		return points[0].Lux
+	}
+	for i := 1; i < len(points); i++ {
+		if v <= points[i].Value {
+			prev, next := points[i-1], points[i]
+			return prev.Lux + (v-prev.Value)*(next.Lux-prev.Lux)/(next.Value-prev.Value)
+		}
+	}
+	return points[len(points)-1].Lux
+}
+
+// 補正後の照度の最大値
+func (c SensorCalibration) maxLux() float64 {
+	if len(c.Illuminance) == 0 {
+		return maxIlluminationValue
+	}
+	lux := 0.0
+	for _, p := range c.Illuminance {
+		lux = max(lux, p.Lux)
+	}
+	return lux
+}
+
+// デバイス ID ごとのセンサーの値の補正
+// (複数のアクセサリーで共有し、設定を読み込み直した時はアクセサリーを作り直さずに差し替える)
+type Calibrations struct {
+	mu   sync.RWMutex
+	byID map[string]SensorCalibration
+}
+
+func NewCalibrations(byID map[string]SensorCalibration) *Calibrations {
+	return &Calibrations{byID: byID}
+}
+
+// 補正を差し替える関数(次に値を取得した時から反映される)
+func (c *Calibrations) Set(byID map[string]SensorCalibration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byID = byID
+}
+
+// デバイスの補正を返す関数(nil や補正がないデバイスの場合は補正しない)
+func (c *Calibrations) Get(id string) SensorCalibration {
+	if c == nil {
+		return SensorCalibration{}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.byID[id]
+}
@@ -0,0 +1,93 @@
+package additionalaccessory
+
+import (
+	"testing"
+
+	"github.com/tenntenn/natureremo"
+)
+
+func TestSensorCalibrationLux(t *testing.T) {
+	table := []LuxPoint{{Value: 20, Lux: 0}, {Value: 100, Lux: 400}, {Value: 180, Lux: 1000}}
+	tests := []struct {
+		name   string
+		points []LuxPoint
+		value  float64
+		want   float64
+	}{
+		{name: "no table", value: 120, want: 120},
+		{name: "on a point", points: table, value: 100, want: 400},
+		{name: "interpolated", points: table, value: 60, want: 200},
+		{name: "interpolated upper", points: table, value: 140, want: 700},
+		// 範囲外は外挿せず、端の lux にする
+		{name: "below range", points: table, value: 0, want: 0},
+		{name: "above range", points: table, value: 200, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := SensorCalibration{Illuminance: tt.points}
+			if got := c.Apply(natureremo.SensorTypeIllumination, tt.value); got != tt.want {
+				t.Errorf("lux(%g) = %g, want %g", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSensorCalibrationMaxLux(t *testing.T) {
+	if got := (SensorCalibration{}).maxLux(); got != maxIlluminationValue {
+		t.Errorf("maxLux without table = %g, want %d", got, maxIlluminationValue)
+	}
+	// 値が増えると暗くなる変換表でも、最も明るい lux を最大値にする
+	c := SensorCalibration{Illuminance: []LuxPoint{{Value: 0, Lux: 800}, {Value: 200, Lux: 10}}}
+	if got := c.maxLux(); got != 800 {
+		t.Errorf("maxLux = %g, want 800", got)
+	}
+}
+
+func TestSensorCalibrationValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		points  []LuxPoint
+		wantErr bool
+	}{
+		{name: "no table"},
+		{name: "two points", points: []LuxPoint{{Value: 0, Lux: 0}, {Value: 200, Lux: 1000}}},
+		{name: "one point", points: []LuxPoint{{Value: 0, Lux: 0}}, wantErr: true},
+		{name: "negative lux", points: []LuxPoint{{Value: 0, Lux: -1}, {Value: 200, Lux: 1000}}, wantErr: true},
+		{name: "not ascending", points: []LuxPoint{{Value: 100, Lux: 0}, {Value: 50, Lux: 1000}}, wantErr: true},
+		{name: "same value", points: []LuxPoint{{Value: 100, Lux: 0}, {Value: 100, Lux: 1000}}, wantErr: true},
+		{name: "all zero lux", points: []LuxPoint{{Value: 0, Lux: 0}, {Value: 200, Lux: 0}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SensorCalibration{Illuminance: tt.points}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSensorCalibrationApply(t *testing.T) {
+	c := SensorCalibration{
+		Temperature: Calibration{Offset: -0.5, Scale: 1.1},
+		Humidity:    Calibration{Offset: 10},
+	}
+	tests := []struct {
+		name       string
+		sensorType natureremo.SensorType
+		value      float64
+		want       float64
+	}{
+		{name: "temperature", sensorType: natureremo.SensorTypeTemperature, value: 20, want: 21.5},
+		{name: "humidity", sensorType: natureremo.SensorTypeHumidity, value: 50, want: 60},
+		{name: "humidity clamped", sensorType: natureremo.SensorTypeHumidity, value: 95, want: 100},
+		{name: "movement unchanged", sensorType: natureremo.SensorTypeMovement, value: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Apply(tt.sensorType, tt.value); got != tt.want {
+				t.Errorf("Apply(%g) = %g, want %g", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+package additionalaccessory
+
+import "errors"
+
+// Nature の情報が足りず、アクセサリーを作れない場合のエラー
+var ErrUnsupported = errors.New("unsupported nature device or appliance")
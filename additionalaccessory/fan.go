@@ -1,7 +1,8 @@
 package additionalaccessory
 
 import (
-	"context"
+	"fmt"
+	"net/http"
 	"regexp"
 	"strconv"
 
@@ -18,33 +19,26 @@ type Fan struct {
 	Fan *service.Fan
 }
 
-func NewFan(nr *natureremo.Client, appliance *natureremo.Appliance) Fan {
+// ファンの操作に使う信号
+type FanSignals struct {
+	// 風量ごとの信号(0 は停止)
+	Speeds map[int]*natureremo.Signal
+	// 風向きごとの信号(for/back)
+	Directions map[string]*natureremo.Signal
+}
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+// 信号のアイコンから、ファンの操作に使う信号を選ぶ関数
+// (数字アイコンを風量、 ico_forward/ico_backward を風向きとして扱う)
+func FanSignalsFromIcons(log *logrus.Entry, signals []*natureremo.Signal) FanSignals {
 
-	nrctx := context.Background()
 	speedRe := regexp.MustCompile(`^ico_number_(\d)$`)
 	directionRe := regexp.MustCompile(`^ico_(.*)ward$`)
 
-	acceInfo := accessory.Info{
-		Name: appliance.Nickname,
-	}
-
-	a := Fan{
-		A:   accessory.New(acceInfo, accessory.TypeFan),
-		Fan: service.NewFan(),
-	}
-
-	signals, err := nr.SignalService.GetAll(nrctx, appliance)
-	if err != nil {
-		log.Fatalf("%s: can't get enough singnals: %s", appliance.Nickname, err)
+	fs := FanSignals{
+		Speeds:     map[int]*natureremo.Signal{},
+		Directions: map[string]*natureremo.Signal{},
 	}
 
-	rotationSpeedSignals := make(map[int]*natureremo.Signal)
-	rotationDirectionSignals := make(map[string]*natureremo.Signal)
-	maxLevel := 0
-
 	// 全てのシグナル情報からHomeKitで操作可能なものを抽出
 	for _, signal := range signals {
 
@@ -52,32 +46,65 @@ func NewFan(nr *natureremo.Client, appliance *natureremo.Appliance) Fan {
 		numberPattern := speedRe.FindSubmatch([]byte(signal.Image))
 		if len(numberPattern) == 2 {
 			level, _ := strconv.Atoi(string(numberPattern[1]))
-			if maxLevel < level {
-				maxLevel = level
-			}
-			log.Debugf("%s: Signal Level%d: %s", appliance.Nickname, level, signal.ID)
-			rotationSpeedSignals[level] = signal
+			log.Debugf("Signal Level%d: %s", level, signal.ID)
+			fs.Speeds[level] = signal
 		}
 
 		// 方向アイコン(風向き)
 		directionPattern := directionRe.FindSubmatch([]byte(signal.Image))
 		if len(directionPattern) == 2 {
 			direction := string(directionPattern[1])
-			log.Debugf("%s: Signal Direction(%s): %s", appliance.Nickname, direction, signal.ID)
-			rotationDirectionSignals[direction] = signal
+			log.Debugf("Signal Direction(%s): %s", direction, signal.ID)
+			fs.Directions[direction] = signal
+		}
+	}
+	return fs
+}
+
+// リモコン式ファンのアクセサリーを、信号のアイコンから作る関数
+// (風量の信号が学習されていない場合はエラーを返し、他のアクセサリーには影響させない)
+func NewFan(log *logrus.Entry, nr util.NatureClient, appliance *natureremo.Appliance, signals []*natureremo.Signal) (Fan, error) {
+	return NewFanWithSignals(log, nr, appliance, FanSignalsFromIcons(log, signals))
+}
+
+// リモコン式ファンのアクセサリーを、指定した信号で作る関数
+func NewFanWithSignals(log *logrus.Entry, nr util.NatureClient, appliance *natureremo.Appliance, signals FanSignals) (Fan, error) {
+
+	acceInfo := accessory.Info{
+		Name: appliance.Nickname,
+	}
+
+	a := Fan{
+		A:   accessory.New(acceInfo, accessory.TypeFan),
+		Fan: service.NewFan(),
+	}
+
+	rotationSpeedSignals := signals.Speeds
+	rotationDirectionSignals := signals.Directions
+	maxLevel := 0
+	for level := range rotationSpeedSignals {
+		if maxLevel < level {
+			maxLevel = level
 		}
 	}
 	if maxLevel == 0 {
-		log.Fatalf("%s: RotationSpeed Signal not found", appliance.Nickname)
+		return Fan{}, fmt.Errorf("%s: %w: RotationSpeed Signal not found", appliance.Nickname, ErrUnsupported)
 	}
 
 	// オフにした時のリモート動作を設定
-	a.Fan.On.OnValueRemoteUpdate(func(v bool) {
+	a.Fan.On.OnValueUpdate(func(v, _ bool, r *http.Request) {
+		if r == nil {
+			return
+		}
 		log.Infof("%s: active changed: %t", appliance.Nickname, v)
 		if !v {
 			targetLevel := 0
 			targetSignal := rotationSpeedSignals[targetLevel]
-			if err := util.SendSignalRequest(nr, targetSignal); err != nil {
+			if targetSignal == nil {
+				log.Errorf("%s: target level(%d) signal is not defined", appliance.Nickname, targetLevel)
+				return
+			}
+			if err := util.SendSignalRequest(r.Context(), nr, appliance, targetSignal, "speed"); err != nil {
 				log.Error(err)
 			} else {
 				log.Debugf("%s: Send signal Successful: %d", appliance.Nickname, targetLevel)
@@ -89,14 +116,17 @@ func NewFan(nr *natureremo.Client, appliance *natureremo.Appliance) Fan {
 	minStep := 100 / maxLevel
 	speed := characteristic.NewRotationSpeed()
 	speed.SetStepValue(float64(minStep))
-	speed.OnValueRemoteUpdate(func(v float64) {
+	speed.OnValueUpdate(func(v, _ float64, r *http.Request) {
+		if r == nil {
+			return
+		}
 		log.Infof("%s: rotation speed changed: %d", appliance.Nickname, int(v))
 		targetLevel := int(v) / minStep
 		if rotationSpeedSignals[targetLevel] == nil {
 			log.Errorf("%s: target level(%d) signal is not defined", appliance.Nickname, targetLevel)
 		} else {
 			targetSignal := rotationSpeedSignals[targetLevel]
-			if err := util.SendSignalRequest(nr, targetSignal); err != nil {
+			if err := util.SendSignalRequest(r.Context(), nr, appliance, targetSignal, "speed"); err != nil {
 				log.Error(err)
 			} else {
 				log.Debugf("%s: Send signal Successful: %d", appliance.Nickname, targetLevel)
@@ -116,27 +146,36 @@ func NewFan(nr *natureremo.Client, appliance *natureremo.Appliance) Fan {
 
 		// 両方向あった時はそれぞれに適した信号に、片方しかない時は回転のたびに同じ信号にする
 		if fFound && bFound {
-			direction.OnValueRemoteUpdate(func(v int) {
+			direction.OnValueUpdate(func(v, _ int, r *http.Request) {
+				if r == nil {
+					return
+				}
 				log.Infof("%s: rotation ditection changed: %d", appliance.Nickname, v)
 				if v == characteristic.RotationDirectionClockwise {
-					if err := util.SendSignalRequest(nr, f); err != nil {
+					if err := util.SendSignalRequest(r.Context(), nr, appliance, f, ""); err != nil {
 						log.Error(err)
 					}
 				} else if v == characteristic.RotationDirectionCounterclockwise {
-					if err := util.SendSignalRequest(nr, b); err != nil {
+					if err := util.SendSignalRequest(r.Context(), nr, appliance, b, ""); err != nil {
 						log.Error(err)
 					}
 				}
 			})
 		} else if fFound {
-			direction.OnValueRemoteUpdate(func(v int) {
-				if err := util.SendSignalRequest(nr, f); err != nil {
+			direction.OnValueUpdate(func(v, _ int, r *http.Request) {
+				if r == nil {
+					return
+				}
+				if err := util.SendSignalRequest(r.Context(), nr, appliance, f, ""); err != nil {
 					log.Error(err)
 				}
 			})
 		} else if bFound {
-			direction.OnValueRemoteUpdate(func(v int) {
-				if err := util.SendSignalRequest(nr, b); err != nil {
+			direction.OnValueUpdate(func(v, _ int, r *http.Request) {
+				if r == nil {
+					return
+				}
+				if err := util.SendSignalRequest(r.Context(), nr, appliance, b, ""); err != nil {
 					log.Error(err)
 				}
 			})
@@ -146,6 +185,7 @@ func NewFan(nr *natureremo.Client, appliance *natureremo.Appliance) Fan {
 		a.Fan.AddC(direction.C)
 	}
 
+	addFaultStatus(log, a.A, a.Fan.S, appliance.Nickname, applianceFault(appliance))
 	a.AddS(a.Fan.S)
-	return a
+	return a, nil
 }
@@ -0,0 +1,143 @@
+package additionalaccessory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestNewFanWithSignalsRotationSpeed(t *testing.T) {
+	off := &natureremo.Signal{ID: "off", Name: "off"}
+	weak := &natureremo.Signal{ID: "weak", Name: "weak"}
+	medium := &natureremo.Signal{ID: "medium", Name: "medium"}
+	strong := &natureremo.Signal{ID: "strong", Name: "strong"}
+	three := map[int]*natureremo.Signal{0: off, 1: weak, 2: medium, 3: strong}
+
+	tests := []struct {
+		name   string
+		speeds map[int]*natureremo.Signal
+		speed  float64
+		want   *natureremo.Signal
+	}{
+		{"level 1 of 3", three, 33, weak},
+		{"level 2 of 3", three, 66, medium},
+		{"level 3 of 3", three, 99, strong},
+		{"level 1 of 2", map[int]*natureremo.Signal{1: weak, 2: strong}, 50, weak},
+		{"level 2 of 2", map[int]*natureremo.Signal{1: weak, 2: strong}, 100, strong},
+		{"undefined level", map[int]*natureremo.Signal{0: off, 3: strong}, 33, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			appliance := &natureremo.Appliance{ID: "fan", Nickname: "Fan"}
+			nr := naturefake.NewClient(nil, []*natureremo.Appliance{appliance})
+
+			a, err := NewFanWithSignals(log, nr, appliance, FanSignals{Speeds: tt.speeds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			speed := findC(t, a.Fan.S, characteristic.TypeRotationSpeed)
+			if _, status := speed.SetValueRequest(tt.speed, request()); status != 0 {
+				t.Fatalf("status = %d", status)
+			}
+
+			cmds := nr.Commands()
+			if tt.want == nil {
+				if len(cmds) != 0 {
+					t.Errorf("commands = %+v, want none", cmds)
+				}
+				return
+			}
+			if len(cmds) != 1 || cmds[0].Signal != tt.want {
+				t.Errorf("commands = %+v, want signal %s", cmds, tt.want.ID)
+			}
+		})
+	}
+}
+
+func TestNewFanWithSignalsOff(t *testing.T) {
+	off := &natureremo.Signal{ID: "off", Name: "off"}
+	weak := &natureremo.Signal{ID: "weak", Name: "weak"}
+
+	tests := []struct {
+		name   string
+		speeds map[int]*natureremo.Signal
+		want   *natureremo.Signal
+	}{
+		{"off signal", map[int]*natureremo.Signal{0: off, 1: weak}, off},
+		{"no off signal", map[int]*natureremo.Signal{1: weak}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			appliance := &natureremo.Appliance{ID: "fan", Nickname: "Fan"}
+			nr := naturefake.NewClient(nil, []*natureremo.Appliance{appliance})
+
+			a, err := NewFanWithSignals(log, nr, appliance, FanSignals{Speeds: tt.speeds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.Fan.On.SetValue(true)
+			if _, status := a.Fan.On.SetValueRequest(false, request()); status != 0 {
+				t.Fatalf("status = %d", status)
+			}
+
+			cmds := nr.Commands()
+			if tt.want == nil {
+				if len(cmds) != 0 {
+					t.Errorf("commands = %+v, want none", cmds)
+				}
+				return
+			}
+			if len(cmds) != 1 || cmds[0].Signal != tt.want {
+				t.Errorf("commands = %+v, want signal %s", cmds, tt.want.ID)
+			}
+		})
+	}
+}
+
+func TestNewFanUnsupported(t *testing.T) {
+	log := setup(t)
+	appliance := &natureremo.Appliance{ID: "fan", Nickname: "Fan"}
+	nr := naturefake.NewClient(nil, []*natureremo.Appliance{appliance})
+
+	signals := []*natureremo.Signal{{ID: "rotate", Image: "ico_forward"}}
+	if _, err := NewFan(log, nr, appliance, signals); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("err = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestFanSignalsFromIcons(t *testing.T) {
+	log := setup(t)
+	signals := []*natureremo.Signal{
+		{ID: "off", Image: "ico_number_0"},
+		{ID: "weak", Image: "ico_number_1"},
+		{ID: "strong", Image: "ico_number_2"},
+		{ID: "for", Image: "ico_forward"},
+		{ID: "back", Image: "ico_backward"},
+		{ID: "timer", Image: "ico_timer"},
+	}
+	fs := FanSignalsFromIcons(log, signals)
+
+	speeds := map[int]string{0: "off", 1: "weak", 2: "strong"}
+	if len(fs.Speeds) != len(speeds) {
+		t.Errorf("Speeds = %v, want %v", fs.Speeds, speeds)
+	}
+	for level, id := range speeds {
+		if s := fs.Speeds[level]; s == nil || s.ID != id {
+			t.Errorf("Speeds[%d] = %v, want %s", level, s, id)
+		}
+	}
+	directions := map[string]string{"for": "for", "back": "back"}
+	if len(fs.Directions) != len(directions) {
+		t.Errorf("Directions = %v, want %v", fs.Directions, directions)
+	}
+	for direction, id := range directions {
+		if s := fs.Directions[direction]; s == nil || s.ID != id {
+			t.Errorf("Directions[%s] = %v, want %s", direction, s, id)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package additionalaccessory
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// テスト用に、キャッシュとコマンドの送信間隔をリセットする
+func setup(t *testing.T) *logrus.Entry {
+	t.Helper()
+	util.ResetCache()
+	util.SetCommandDebounce(0)
+	t.Cleanup(func() {
+		util.ResetCache()
+		util.SetCommandDebounce(util.DefaultCommandDebounce)
+	})
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return logrus.NewEntry(l)
+}
+
+// HomeKit のコントローラーからのリクエストの代わり
+func request() *http.Request {
+	return httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+}
+
+func newDevice(id, name string, events map[natureremo.SensorType]float64, createdAt time.Time) *natureremo.Device {
+	d := &natureremo.Device{
+		DeviceCore:   natureremo.DeviceCore{ID: id, Name: name},
+		NewestEvents: map[natureremo.SensorType]natureremo.SensorValue{},
+	}
+	for st, v := range events {
+		d.NewestEvents[st] = natureremo.SensorValue{Value: v, CreatedAt: createdAt}
+	}
+	return d
+}
+
+func newAirCon(device *natureremo.Device, settings natureremo.AirConSettings) *natureremo.Appliance {
+	temps := []string{"18", "19", "20", "21", "22", "23", "24", "25", "26", "27", "28", "29", "30"}
+	return &natureremo.Appliance{
+		ID:       "aircon",
+		Type:     natureremo.ApplianceTypeAirCon,
+		Device:   &device.DeviceCore,
+		Model:    &natureremo.ApplianceModel{Manufacturer: "daikin", RemoteName: "arc"},
+		Nickname: "AirCon",
+		AirCon: &natureremo.AirCon{
+			Range: &natureremo.AirConRange{
+				Modes: map[natureremo.OperationMode]*natureremo.AirConRangeMode{
+					natureremo.OperationModeCool: {Temperature: temps},
+					natureremo.OperationModeWarm: {Temperature: temps},
+				},
+			},
+		},
+		AirConSettings: &settings,
+	}
+}
+
+// サービスから characteristic を種類で探す
+func findC(t *testing.T, s *service.S, typ string) *characteristic.C {
+	t.Helper()
+	for _, c := range s.Cs {
+		if c.Type == typ {
+			return c
+		}
+	}
+	t.Fatalf("characteristic %s was not found in service %s", typ, s.Type)
+	return nil
+}
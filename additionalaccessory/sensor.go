@@ -1,10 +1,14 @@
 package additionalaccessory
 
 import (
+	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/service"
 	"github.com/legnoh/hap-nature-remo/util"
 	"github.com/sirupsen/logrus"
@@ -15,10 +19,67 @@ type Sensor struct {
 	*accessory.A
 }
 
-func NewSensor(nr *natureremo.Client, device *natureremo.Device) Sensor {
+// 人感センサーを公開するサービス
+const (
+	// 人感センサー(デフォルト)
+	MotionServiceMotion = "motion"
+	// 在室センサー
+	MotionServiceOccupancy = "occupancy"
+	// 人感センサーと在室センサーの両方
+	MotionServiceBoth = "both"
+)
+
+// 動きを検知したとみなす、最後の検知からの時間のデフォルト
+const (
+	defaultMotionWindow    = 5 * time.Minute
+	defaultOccupancyWindow = 30 * time.Minute
+)
+
+// センサーのアクセサリーの設定
+type SensorOptions struct {
+	// デバイス ID ごとのセンサーの値の補正(照度の変換表の最大値は作った時のものを使う)
+	Calibrations *Calibrations
+	// 人感センサーを公開するサービス(空の場合は人感センサー)
+	MotionService string
+	// 人感センサー・在室センサーが検知したとみなす、最後の検知からの時間(0 の場合はデフォルト)
+	MotionWindow    time.Duration
+	OccupancyWindow time.Duration
+}
+
+func (o SensorOptions) motionWindow() time.Duration {
+	if o.MotionWindow == 0 {
+		return defaultMotionWindow
+	}
+	return o.MotionWindow
+}
+
+func (o SensorOptions) occupancyWindow() time.Duration {
+	if o.OccupancyWindow == 0 {
+		return defaultOccupancyWindow
+	}
+	return o.OccupancyWindow
+}
+
+// 人感センサーの最後の検知時刻を覚えておくもの
+// (移動イベントの値は検知後も 1 のままのため、イベントの時刻が変わったことで検知したとみなす)
+type motionTracker struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// 移動イベントの時刻が進んでいれば検知時刻を更新し、最後の検知からの経過時間を返す
+func (t *motionTracker) observe(ev natureremo.SensorValue) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ev.CreatedAt.After(t.last) {
+		t.last = ev.CreatedAt
+	}
+	return time.Since(t.last)
+}
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+// Remo デバイスのセンサーのアクセサリーを作る関数
+// (対応しているセンサーが1つもない場合はエラーを返す)
+func NewSensor(log *logrus.Entry, nr util.NatureClient, device *natureremo.Device, opts SensorOptions) (Sensor, error) {
 
 	acceInfo := accessory.Info{
 		Name:         device.DeviceCore.Name,
@@ -30,117 +91,144 @@ func NewSensor(nr *natureremo.Client, device *natureremo.Device) Sensor {
 	a := Sensor{
 		A: accessory.New(acceInfo, accessory.TypeSensor),
 	}
+	fault := func() error { return util.DeviceFault(device.ID) }
+	cal := opts.Calibrations.Get(device.ID)
 
 	if te, found := device.NewestEvents[natureremo.SensorTypeTemperature]; found {
-		log.Infof("Temperature Sensor Detected(%s): %.1f", device.Name, te.Value)
+		temp := cal.Apply(natureremo.SensorTypeTemperature, te.Value)
+		log.Infof("Temperature Sensor Detected(%s): %.1f", device.Name, temp)
 		temperatureSensor := service.NewTemperatureSensor()
-		temperatureSensor.CurrentTemperature.SetValue(te.Value)
+		temperatureSensor.CurrentTemperature.SetValue(temp)
 
-		temperatureSensor.CurrentTemperature.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		temperatureSensor.CurrentTemperature.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 			log.Debugf("%s: Get now Temperature Request", device.Name)
-			devices := util.GetDevices(nr)
+			devices := util.GetDevices(util.RequestContext(r), nr)
 			for _, remoteDevice := range devices.Devices {
 				if remoteDevice.Name == device.Name {
-					temp := remoteDevice.NewestEvents[natureremo.SensorTypeTemperature].Value
+					temp := opts.Calibrations.Get(device.ID).Apply(natureremo.SensorTypeTemperature, remoteDevice.NewestEvents[natureremo.SensorTypeTemperature].Value)
 					log.Infof("%s: Get now Temperature Request Successful: %.1f", device.Name, temp)
 					return temp, 0
 				}
 			}
 			log.Warnf("%s: Get now Temperature Request devices was not found", device.Name)
-			return nil, -1
+			return nil, hap.JsonStatusServiceCommunicationFailure
 		}
+		addFaultStatus(log, a.A, temperatureSensor.S, device.Name, fault)
 		a.AddS(temperatureSensor.S)
 	}
 
 	if hu, found := device.NewestEvents[natureremo.SensorTypeHumidity]; found {
-		log.Infof("Humidity Sensor Detected(%s): %.0f", device.Name, hu.Value)
+		humi := cal.Apply(natureremo.SensorTypeHumidity, hu.Value)
+		log.Infof("Humidity Sensor Detected(%s): %.0f", device.Name, humi)
 		humiditySensor := service.NewHumiditySensor()
-		humiditySensor.CurrentRelativeHumidity.SetValue(hu.Value)
+		humiditySensor.CurrentRelativeHumidity.SetValue(humi)
 
-		humiditySensor.CurrentRelativeHumidity.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		humiditySensor.CurrentRelativeHumidity.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 			log.Debugf("%s: Get now Humidity Request", device.Name)
-			devices := util.GetDevices(nr)
+			devices := util.GetDevices(util.RequestContext(r), nr)
 			for _, remoteDevice := range devices.Devices {
 				if remoteDevice.Name == device.Name {
-					humi := remoteDevice.NewestEvents[natureremo.SensorTypeHumidity].Value
+					humi := opts.Calibrations.Get(device.ID).Apply(natureremo.SensorTypeHumidity, remoteDevice.NewestEvents[natureremo.SensorTypeHumidity].Value)
 					log.Infof("%s: Get now Humidity Request Successful: %.0f", device.Name, humi)
 					return humi, 0
 				}
 			}
 			log.Warnf("%s: Get now Humidity Request devices was not found", device.Name)
-			return nil, -1
+			return nil, hap.JsonStatusServiceCommunicationFailure
 		}
+		addFaultStatus(log, a.A, humiditySensor.S, device.Name, fault)
 		a.AddS(humiditySensor.S)
 	}
 
+	// 照度センサーの値は lux ではないため、変換表がある場合は lux に変換する
 	if il, found := device.NewestEvents[natureremo.SensorTypeIllumination]; found {
-		log.Infof("Illumination Sensor Detected(%s): %.0f", device.Name, il.Value)
+		illu := cal.Apply(natureremo.SensorTypeIllumination, il.Value)
+		log.Infof("Illumination Sensor Detected(%s): %.0f", device.Name, illu)
 		lightSensor := service.NewLightSensor()
 		lightSensor.CurrentAmbientLightLevel.SetMinValue(0)
-		lightSensor.CurrentAmbientLightLevel.SetMaxValue(200)
+		lightSensor.CurrentAmbientLightLevel.SetMaxValue(cal.maxLux())
 		lightSensor.CurrentAmbientLightLevel.SetStepValue(1)
-		lightSensor.CurrentAmbientLightLevel.SetValue(il.Value)
+		lightSensor.CurrentAmbientLightLevel.SetValue(illu)
 
-		lightSensor.CurrentAmbientLightLevel.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+		lightSensor.CurrentAmbientLightLevel.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 			log.Debugf("%s: Get now LightLevel Request", device.Name)
-			devices := util.GetDevices(nr)
+			devices := util.GetDevices(util.RequestContext(r), nr)
 			for _, remoteDevice := range devices.Devices {
 				if remoteDevice.DeviceCore.Name == device.DeviceCore.Name {
-					illu := remoteDevice.NewestEvents[natureremo.SensorTypeIllumination].Value
+					illu := opts.Calibrations.Get(device.ID).Apply(natureremo.SensorTypeIllumination, remoteDevice.NewestEvents[natureremo.SensorTypeIllumination].Value)
 					log.Infof("%s: Get now Lightlevel Request Successful: %.0f", device.Name, illu)
 					return illu, 0
 				}
 			}
 			log.Warnf("%s: Get now Illuminate Request devices was not found", device.Name)
-			return nil, -1
+			return nil, hap.JsonStatusServiceCommunicationFailure
 		}
+		addFaultStatus(log, a.A, lightSensor.S, device.Name, fault)
 		a.AddS(lightSensor.S)
 	}
 
 	if mo, found := device.NewestEvents[natureremo.SensorTypeMovement]; found {
-		log.Infof("Movement Sensor Detected(%s): %.1f", device.Name, mo.Value)
-		motionSensor := service.NewMotionSensor()
-		if mo.Value == 0 {
-			motionSensor.MotionDetected.SetValue(false)
-		} else {
-			// モーションセンサーは基本的に常時ONで返される仕様らしいので、
-			// 更新から5分以内の場合のみ検知したものとして扱う
-			now := time.Now()
-			if now.Sub(mo.CreatedAt).Minutes() > 5 {
-				motionSensor.MotionDetected.SetValue(false)
-			} else {
-				motionSensor.MotionDetected.SetValue(true)
+		log.Infof("Movement Sensor Detected(%s): %s", device.Name, mo.CreatedAt.Format(time.DateTime))
+		motion := &motionTracker{last: mo.CreatedAt}
+
+		// 最新の移動イベントの時刻を取得し直し、検知からの経過時間を返す
+		elapsed := func(r *http.Request) (time.Duration, bool) {
+			devices := util.GetDevices(util.RequestContext(r), nr)
+			for _, remoteDevice := range devices.Devices {
+				if remoteDevice.ID == device.ID {
+					return motion.observe(remoteDevice.NewestEvents[natureremo.SensorTypeMovement]), true
+				}
 			}
+			return 0, false
 		}
 
-		motionSensor.MotionDetected.ValueRequestFunc = func(*http.Request) (interface{}, int) {
-			log.Debugf("%s: Get now MotionSensor Request", device.Name)
-			devices := util.GetDevices(nr)
-			for _, remoteDevice := range devices.Devices {
-				if remoteDevice.Name == device.Name {
-					state := remoteDevice.NewestEvents[natureremo.SensorTypeTemperature]
-					if state.Value == 0 {
-						log.Infof("%s: Get now Motion Request Successful: %t", device.Name, false)
-						return false, 0
-					} else {
-						// モーションセンサーは基本的に常時ONで返される仕様らしいので、
-						// 更新から5分以内の場合のみ検知したものとして扱う
-						now := time.Now()
-						if now.Sub(state.CreatedAt).Minutes() > 5 {
-							log.Infof("%s: Get now Motion Request Successful: %t", device.Name, false)
-							return false, 0
-						} else {
-							log.Infof("%s: Get now Motion Request Successful: %t", device.Name, true)
-							return true, 0
-						}
-					}
+		if opts.MotionService != MotionServiceOccupancy {
+			window := opts.motionWindow()
+			motionSensor := service.NewMotionSensor()
+			motionSensor.MotionDetected.SetValue(time.Since(mo.CreatedAt) <= window)
+
+			motionSensor.MotionDetected.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+				log.Debugf("%s: Get now MotionSensor Request", device.Name)
+				if d, found := elapsed(r); found {
+					detected := d <= window
+					log.Infof("%s: Get now Motion Request Successful: %t", device.Name, detected)
+					return detected, 0
 				}
+				log.Warnf("%s: Get now Movement Request devices was not found", device.Name)
+				return nil, hap.JsonStatusServiceCommunicationFailure
 			}
-			log.Warnf("%s: Get now Movement Request devices was not found", device.Name)
-			return nil, -1
+			addFaultStatus(log, a.A, motionSensor.S, device.Name, fault)
+			a.AddS(motionSensor.S)
+		}
+
+		if opts.MotionService == MotionServiceOccupancy || opts.MotionService == MotionServiceBoth {
+			window := opts.occupancyWindow()
+			occupancy := func(d time.Duration) int {
+				if d <= window {
+					return characteristic.OccupancyDetectedOccupancyDetected
+				}
+				return characteristic.OccupancyDetectedOccupancyNotDetected
+			}
+			occupancySensor := service.NewOccupancySensor()
+			occupancySensor.OccupancyDetected.SetValue(occupancy(time.Since(mo.CreatedAt)))
+
+			occupancySensor.OccupancyDetected.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+				log.Debugf("%s: Get now OccupancySensor Request", device.Name)
+				if d, found := elapsed(r); found {
+					detected := occupancy(d)
+					log.Infof("%s: Get now Occupancy Request Successful: %d", device.Name, detected)
+					return detected, 0
+				}
+				log.Warnf("%s: Get now Occupancy Request devices was not found", device.Name)
+				return nil, hap.JsonStatusServiceCommunicationFailure
+			}
+			addFaultStatus(log, a.A, occupancySensor.S, device.Name, fault)
+			a.AddS(occupancySensor.S)
 		}
-		a.AddS(motionSensor.S)
 	}
 
-	return a
+	if len(a.Ss) == 1 {
+		return Sensor{}, fmt.Errorf("%s: %w: no supported sensor", device.Name, ErrUnsupported)
+	}
+	return a, nil
 }
@@ -0,0 +1,224 @@
+package additionalaccessory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+// センサーのサービスを種類で探す(見つからない場合は nil)
+func findS(a Sensor, typ string) *service.S {
+	for _, s := range a.Ss {
+		if s.Type == typ {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestNewSensorValues(t *testing.T) {
+	events := map[natureremo.SensorType]float64{
+		natureremo.SensorTypeTemperature:  24.5,
+		natureremo.SensorTypeHumidity:     48,
+		natureremo.SensorTypeIllumination: 120,
+	}
+	tests := []struct {
+		name        string
+		calibration SensorCalibration
+		temperature float64
+		humidity    float64
+		light       float64
+	}{
+		{"raw", SensorCalibration{}, 24.5, 48, 120},
+		{"offset and scale", SensorCalibration{Temperature: Calibration{Offset: -1.5}, Humidity: Calibration{Scale: 1.25}}, 23, 60, 120},
+		{"humidity clamped", SensorCalibration{Humidity: Calibration{Offset: 60}}, 24.5, 100, 120},
+		{"lux table", SensorCalibration{Illuminance: []LuxPoint{{Value: 0, Lux: 0}, {Value: 100, Lux: 400}, {Value: 200, Lux: 1000}}}, 24.5, 48, 520},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			device := newDevice("remo", "Remo", events, time.Now())
+			nr := naturefake.NewClient([]*natureremo.Device{device}, nil)
+
+			a, err := NewSensor(log, nr, device, SensorOptions{Calibrations: NewCalibrations(map[string]SensorCalibration{device.ID: tt.calibration})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				service, characteristic string
+				want                    float64
+			}{
+				{service.TypeTemperatureSensor, characteristic.TypeCurrentTemperature, tt.temperature},
+				{service.TypeHumiditySensor, characteristic.TypeCurrentRelativeHumidity, tt.humidity},
+				{service.TypeLightSensor, characteristic.TypeCurrentAmbientLightLevel, tt.light},
+			} {
+				s := findS(a, c.service)
+				if s == nil {
+					t.Fatalf("service %s was not found", c.service)
+				}
+				ch := findC(t, s, c.characteristic)
+				if got := ch.Value(); got != c.want {
+					t.Errorf("initial %s = %v, want %g", c.characteristic, got, c.want)
+				}
+				if got, status := ch.ValueRequest(request()); status != 0 || got != c.want {
+					t.Errorf("%s = %v(%d), want %g", c.characteristic, got, status, c.want)
+				}
+			}
+		})
+	}
+}
+
+// 補正を差し替えると、作り直さずに次の取得から反映される
+func TestNewSensorCalibrationsReplaced(t *testing.T) {
+	log := setup(t)
+	device := newDevice("remo", "Remo", map[natureremo.SensorType]float64{natureremo.SensorTypeTemperature: 24.5}, time.Now())
+	nr := naturefake.NewClient([]*natureremo.Device{device}, nil)
+	cals := NewCalibrations(nil)
+
+	a, err := NewSensor(log, nr, device, SensorOptions{Calibrations: cals})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cals.Set(map[string]SensorCalibration{device.ID: {Temperature: Calibration{Offset: -1.5}}})
+	ch := findC(t, findS(a, service.TypeTemperatureSensor), characteristic.TypeCurrentTemperature)
+	if got, status := ch.ValueRequest(request()); status != 0 || got != 23.0 {
+		t.Errorf("temperature = %v(%d), want 23", got, status)
+	}
+}
+
+func TestNewSensorUnsupported(t *testing.T) {
+	log := setup(t)
+	device := newDevice("nano", "Remo nano", nil, time.Now())
+	nr := naturefake.NewClient([]*natureremo.Device{device}, nil)
+
+	if _, err := NewSensor(log, nr, device, SensorOptions{}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("err = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestNewSensorMotion(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      SensorOptions
+		ago       time.Duration
+		motion    interface{}
+		occupancy interface{}
+	}{
+		{"recent motion", SensorOptions{}, time.Minute, true, nil},
+		{"old motion", SensorOptions{}, 10 * time.Minute, false, nil},
+		{"custom motion window", SensorOptions{MotionWindow: 15 * time.Minute}, 10 * time.Minute, true, nil},
+		{"occupied", SensorOptions{MotionService: MotionServiceOccupancy}, 10 * time.Minute, nil, characteristic.OccupancyDetectedOccupancyDetected},
+		{"not occupied", SensorOptions{MotionService: MotionServiceOccupancy}, time.Hour, nil, characteristic.OccupancyDetectedOccupancyNotDetected},
+		{"both", SensorOptions{MotionService: MotionServiceBoth}, 10 * time.Minute, false, characteristic.OccupancyDetectedOccupancyDetected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := setup(t)
+			events := map[natureremo.SensorType]float64{natureremo.SensorTypeMovement: 1}
+			device := newDevice("remo", "Remo", events, time.Now().Add(-tt.ago))
+			nr := naturefake.NewClient([]*natureremo.Device{device}, nil)
+
+			a, err := NewSensor(log, nr, device, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []struct {
+				service, characteristic string
+				want                    interface{}
+			}{
+				{service.TypeMotionSensor, characteristic.TypeMotionDetected, tt.motion},
+				{service.TypeOccupancySensor, characteristic.TypeOccupancyDetected, tt.occupancy},
+			} {
+				s := findS(a, c.service)
+				if c.want == nil {
+					if s != nil {
+						t.Errorf("service %s should not exist", c.service)
+					}
+					continue
+				}
+				if s == nil {
+					t.Fatalf("service %s was not found", c.service)
+				}
+				ch := findC(t, s, c.characteristic)
+				if got := ch.Value(); got != c.want {
+					t.Errorf("initial %s = %v, want %v", c.characteristic, got, c.want)
+				}
+				if got, status := ch.ValueRequest(request()); status != 0 || got != c.want {
+					t.Errorf("%s = %v(%d), want %v", c.characteristic, got, status, c.want)
+				}
+			}
+		})
+	}
+}
+
+// 移動イベントの時刻が進んだ場合に、検知したとみなす
+func TestNewSensorMotionUpdated(t *testing.T) {
+	log := setup(t)
+	events := map[natureremo.SensorType]float64{natureremo.SensorTypeMovement: 1}
+	device := newDevice("remo", "Remo", events, time.Now().Add(-time.Hour))
+	nr := naturefake.NewClient([]*natureremo.Device{device}, nil)
+
+	a, err := NewSensor(log, nr, device, SensorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	detected := findC(t, findS(a, service.TypeMotionSensor), characteristic.TypeMotionDetected)
+	if got, _ := detected.ValueRequest(request()); got != false {
+		t.Fatalf("MotionDetected = %v, want false", got)
+	}
+
+	nr.SetDevices([]*natureremo.Device{newDevice("remo", "Remo", events, time.Now())})
+	util.ResetCache()
+	if got, _ := detected.ValueRequest(request()); got != true {
+		t.Errorf("MotionDetected = %v, want true", got)
+	}
+}
+
+// 移動イベントの時刻が進んだ場合だけ検知時刻を更新する
+// (キャッシュの古い値や、時刻のない値で検知時刻を戻さない)
+func TestMotionTrackerObserve(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	motion := &motionTracker{last: start}
+
+	steps := []struct {
+		name      string
+		createdAt time.Time
+		want      time.Time
+	}{
+		{"same event", start, start},
+		{"older event", start.Add(-time.Minute), start},
+		{"missing event", time.Time{}, start},
+		{"newer event", start.Add(50 * time.Minute), start.Add(50 * time.Minute)},
+		{"stale after newer", start.Add(10 * time.Minute), start.Add(50 * time.Minute)},
+	}
+	for _, s := range steps {
+		before := time.Now()
+		elapsed := motion.observe(natureremo.SensorValue{Value: 1, CreatedAt: s.createdAt})
+		after := time.Now()
+		if elapsed < before.Sub(s.want) || elapsed > after.Sub(s.want) {
+			t.Errorf("%s: elapsed = %s, want %s", s.name, elapsed, before.Sub(s.want))
+		}
+	}
+}
+
+func TestSensorOptionsWindows(t *testing.T) {
+	if got := (SensorOptions{}).motionWindow(); got != defaultMotionWindow {
+		t.Errorf("default motion window = %s, want %s", got, defaultMotionWindow)
+	}
+	if got := (SensorOptions{}).occupancyWindow(); got != defaultOccupancyWindow {
+		t.Errorf("default occupancy window = %s, want %s", got, defaultOccupancyWindow)
+	}
+	opts := SensorOptions{MotionWindow: time.Minute, OccupancyWindow: time.Hour}
+	if got := opts.motionWindow(); got != time.Minute {
+		t.Errorf("motion window = %s, want 1m", got)
+	}
+	if got := opts.occupancyWindow(); got != time.Hour {
+		t.Errorf("occupancy window = %s, want 1h", got)
+	}
+}
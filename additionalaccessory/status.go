@@ -0,0 +1,85 @@
+package additionalaccessory
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// アクセサリーごとの、作り直す際に止める処理
+var (
+	releaseMu sync.Mutex
+	releasers = map[*accessory.A][]func(){}
+)
+
+// アクセサリーを作り直す際に、古いアクセサリーの状態更新を止める関数
+func Release(a *accessory.A) {
+	releaseMu.Lock()
+	fns := releasers[a]
+	delete(releasers, a)
+	releaseMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+func onRelease(a *accessory.A, fn func()) {
+	releaseMu.Lock()
+	defer releaseMu.Unlock()
+	releasers[a] = append(releasers[a], fn)
+}
+
+// アクセサリーのサービスに StatusFault/StatusActive を追加する関数
+// (fault がエラーを返す間は障害中として扱い、 Nature API の接続状態が変わるたびに更新する)
+func addFaultStatus(log *logrus.Entry, a *accessory.A, s *service.S, name string, fault func() error) {
+
+	statusFault := characteristic.NewStatusFault()
+	statusActive := characteristic.NewStatusActive()
+
+	var mu sync.Mutex
+	update := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		err := fault()
+		if err != nil && statusActive.Value() {
+			log.Debugf("%s: marked as fault: %s", name, err)
+		} else if err == nil && !statusActive.Value() {
+			log.Debugf("%s: recovered from fault", name)
+		}
+		if err != nil {
+			statusFault.SetValue(characteristic.StatusFaultGeneralFault)
+			statusActive.SetValue(false)
+		} else {
+			statusFault.SetValue(characteristic.StatusFaultNoFault)
+			statusActive.SetValue(true)
+		}
+	}
+	update()
+	onRelease(a, util.OnHealthChange(update))
+
+	statusFault.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+		update()
+		return statusFault.Value(), 0
+	}
+	statusActive.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
+		update()
+		return statusActive.Value(), 0
+	}
+
+	s.AddC(statusFault.C)
+	s.AddC(statusActive.C)
+}
+
+// 家電の障害状態(家電を登録している Remo デバイスの状態)を返す関数を作る
+func applianceFault(appliance *natureremo.Appliance) func() error {
+	if appliance.Device == nil {
+		return util.CloudFault
+	}
+	return func() error { return util.DeviceFault(appliance.Device.ID) }
+}
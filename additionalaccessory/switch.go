@@ -0,0 +1,105 @@
+package additionalaccessory
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// ボタン式のスイッチがオフに戻るまでの時間
+const buttonResetDelay = time.Second
+
+type Switch struct {
+	*accessory.A
+	// 電源のスイッチ(on/off の信号がない場合は nil)
+	Power *service.Switch
+	// 信号ごとのボタン式のスイッチ
+	Buttons []*service.Switch
+}
+
+// スイッチの操作に使う信号
+type SwitchSignals struct {
+	// 電源を入れる信号(Off がない場合はトグル式の信号として扱う)
+	On *natureremo.Signal
+	// 電源を切る信号
+	Off *natureremo.Signal
+	// 押すたびに送る信号(1信号ごとに、送信後にオフに戻るスイッチを作る)
+	Buttons []*natureremo.Signal
+}
+
+// リモコン式の家電を、信号を送るスイッチとして扱うアクセサリーを作る関数
+func NewSwitch(log *logrus.Entry, nr util.NatureClient, appliance *natureremo.Appliance, signals SwitchSignals) (Switch, error) {
+
+	if signals.On == nil && len(signals.Buttons) == 0 {
+		return Switch{}, fmt.Errorf("%s: %w: Switch Signal not found", appliance.Nickname, ErrUnsupported)
+	}
+
+	acceInfo := accessory.Info{
+		Name: appliance.Nickname,
+	}
+
+	a := Switch{
+		A: accessory.New(acceInfo, accessory.TypeSwitch),
+	}
+
+	// 電源のスイッチ(状態を指定できない場合は、二重送信を防ぐためにまとめずに送る)
+	if signals.On != nil {
+		a.Power = service.NewSwitch()
+		group := ""
+		if signals.Off != nil {
+			group = "power"
+		}
+		a.Power.On.OnValueUpdate(func(v, _ bool, r *http.Request) {
+			if r == nil {
+				return
+			}
+			log.Infof("%s: power changed: %t", appliance.Nickname, v)
+			signal := signals.On
+			if !v && signals.Off != nil {
+				signal = signals.Off
+			}
+			if err := util.SendSignalRequest(r.Context(), nr, appliance, signal, group); err != nil {
+				log.Error(err)
+			} else {
+				log.Debugf("%s: Send signal Successful: %s", appliance.Nickname, signal.Name)
+			}
+		})
+		addFaultStatus(log, a.A, a.Power.S, appliance.Nickname, applianceFault(appliance))
+		a.AddS(a.Power.S)
+	}
+
+	// ボタン式のスイッチ(Home アプリで区別できるよう、信号名をつける)
+	for _, signal := range signals.Buttons {
+		button := service.NewSwitch()
+		name := characteristic.NewName()
+		name.SetValue(signal.Name)
+		button.AddC(name.C)
+		button.On.OnValueUpdate(func(v, _ bool, r *http.Request) {
+			if r == nil || !v {
+				return
+			}
+			log.Infof("%s: button pressed: %s", appliance.Nickname, signal.Name)
+			if err := util.SendSignalRequest(r.Context(), nr, appliance, signal, ""); err != nil {
+				log.Error(err)
+			} else {
+				log.Debugf("%s: Send signal Successful: %s", appliance.Nickname, signal.Name)
+			}
+			time.AfterFunc(buttonResetDelay, func() {
+				button.On.SetValue(false)
+			})
+		})
+		a.Buttons = append(a.Buttons, button)
+		a.AddS(button.S)
+	}
+	if a.Power == nil {
+		addFaultStatus(log, a.A, a.Buttons[0].S, appliance.Nickname, applianceFault(appliance))
+	}
+	return a, nil
+}
@@ -0,0 +1,61 @@
+package additionalaccessory
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+type WindowCovering struct {
+	*accessory.A
+	WindowCovering *service.WindowCovering
+}
+
+// リモコン式のカーテン・シャッターなどのアクセサリーを作る関数
+// (位置は指定できないため、50%以上で開ける信号を、それ未満で閉める信号を送る)
+func NewWindowCovering(log *logrus.Entry, nr util.NatureClient, appliance *natureremo.Appliance, open, close *natureremo.Signal) (WindowCovering, error) {
+
+	if open == nil || close == nil {
+		return WindowCovering{}, fmt.Errorf("%s: %w: open/close Signal not found", appliance.Nickname, ErrUnsupported)
+	}
+
+	acceInfo := accessory.Info{
+		Name: appliance.Nickname,
+	}
+
+	a := WindowCovering{
+		A:              accessory.New(acceInfo, accessory.TypeWindowCovering),
+		WindowCovering: service.NewWindowCovering(),
+	}
+
+	wc := a.WindowCovering
+	wc.PositionState.SetValue(characteristic.PositionStateStopped)
+	wc.TargetPosition.SetStepValue(100)
+	wc.TargetPosition.OnValueUpdate(func(v, _ int, r *http.Request) {
+		if r == nil {
+			return
+		}
+		log.Infof("%s: target position changed: %d", appliance.Nickname, v)
+		signal, position := close, 0
+		if v >= 50 {
+			signal, position = open, 100
+		}
+		if err := util.SendSignalRequest(r.Context(), nr, appliance, signal, "position"); err != nil {
+			log.Error(err)
+			return
+		}
+		log.Debugf("%s: Send signal Successful: %s", appliance.Nickname, signal.Name)
+		wc.TargetPosition.SetValue(position)
+		wc.CurrentPosition.SetValue(position)
+	})
+
+	addFaultStatus(log, a.A, wc.S, appliance.Nickname, applianceFault(appliance))
+	a.AddS(wc.S)
+	return a, nil
+}
@@ -1,21 +1,23 @@
 package additionalcharacteristic
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 
+	"github.com/brutella/hap"
 	"github.com/brutella/hap/characteristic"
 	"github.com/legnoh/hap-nature-remo/util"
 	"github.com/sirupsen/logrus"
 	"github.com/tenntenn/natureremo"
 )
 
-func NewCoolingThresholdTemperature(f *natureremo.AirConRangeMode, nr *natureremo.Client, ac *natureremo.Appliance) *characteristic.CoolingThresholdTemperature {
+func NewCoolingThresholdTemperature(log *logrus.Entry, f *natureremo.AirConRangeMode, nr util.NatureClient, ac *natureremo.Appliance) (*characteristic.CoolingThresholdTemperature, error) {
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
-	min, max, step := util.GetStepInfo(f.Temperature)
+	min, max, step, err := util.GetStepInfo(f.Temperature)
+	if err != nil {
+		return nil, fmt.Errorf("cooling temperature range: %w", err)
+	}
 	log.Debugf("Cooling range: %2f ~ %2f", min, max)
 
 	threshold := *characteristic.NewCoolingThresholdTemperature()
@@ -26,29 +28,32 @@ func NewCoolingThresholdTemperature(f *natureremo.AirConRangeMode, nr *naturerem
 	threshold.SetValue(nowSetting)
 
 	// 設定温度が変わった時の処理
-	threshold.OnValueRemoteUpdate(func(v float64) {
+	threshold.OnValueUpdate(func(v, _ float64, r *http.Request) {
+		if r == nil {
+			return
+		}
 		target := strconv.FormatFloat(v, 'f', -1, 64)
 		setting := natureremo.AirConSettings{
 			Temperature: target,
 		}
 		log.Infof("AirConditioner(Cooler) Temperature Updating: %s", target)
-		err := util.SendAirconRequest(nr, ac, &setting)
+		err := util.SendAirconRequest(r.Context(), nr, ac, &setting)
 		if err != nil {
 			log.Error(err)
 		}
 	})
 
 	// 現在の設定値を呼び出された時の処理
-	threshold.ValueRequestFunc = func(*http.Request) (interface{}, int) {
+	threshold.ValueRequestFunc = func(r *http.Request) (interface{}, int) {
 		log.Debug("Get now AirConditioner threshold Request")
-		aps := util.GetAppliances(nr)
+		aps := util.GetAppliances(util.RequestContext(r), nr)
 		for _, ap := range aps.Appliances {
-			if ap.ID == ac.ID {
-				temp, _ := strconv.ParseFloat(ac.AirConSettings.Temperature, 64)
+			if ap.ID == ac.ID && ap.AirConSettings != nil {
+				temp, _ := strconv.ParseFloat(ap.AirConSettings.Temperature, 64)
 				return temp, 0
 			}
 		}
-		return nil, -1
+		return nil, hap.JsonStatusServiceCommunicationFailure
 	}
-	return &threshold
+	return &threshold, nil
 }
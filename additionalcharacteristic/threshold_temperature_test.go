@@ -0,0 +1,107 @@
+package additionalcharacteristic
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestThresholdTemperature(t *testing.T) {
+	newCooling := func(log *logrus.Entry, f *natureremo.AirConRangeMode, nr util.NatureClient, ac *natureremo.Appliance) (*characteristic.Float, error) {
+		c, err := NewCoolingThresholdTemperature(log, f, nr, ac)
+		if err != nil {
+			return nil, err
+		}
+		return c.Float, nil
+	}
+	newHeating := func(log *logrus.Entry, f *natureremo.AirConRangeMode, nr util.NatureClient, ac *natureremo.Appliance) (*characteristic.Float, error) {
+		c, err := NewHeatingThresholdTemperature(log, f, nr, ac)
+		if err != nil {
+			return nil, err
+		}
+		return c.Float, nil
+	}
+
+	tests := []struct {
+		name    string
+		new     func(*logrus.Entry, *natureremo.AirConRangeMode, util.NatureClient, *natureremo.Appliance) (*characteristic.Float, error)
+		temps   []string
+		current string
+		min     float64
+		max     float64
+		step    float64
+		write   float64
+		sent    string
+		wantErr bool
+	}{
+		{name: "cooling", new: newCooling, temps: []string{"18", "19", "20", "30"}, current: "26", min: 18, max: 30, step: 1, write: 24, sent: "24"},
+		{name: "heating half step", new: newHeating, temps: []string{"20.5", "20", "21"}, current: "20.5", min: 20, max: 21, step: 0.5, write: 21, sent: "21"},
+		{name: "cooling half degree", new: newCooling, temps: []string{"26", "26.5", "27"}, current: "26", min: 26, max: 27, step: 0.5, write: 26.5, sent: "26.5"},
+		{name: "invalid range", new: newHeating, temps: []string{"auto"}, wantErr: true},
+		{name: "too few values", new: newCooling, temps: []string{"25"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			util.ResetCache()
+			util.SetCommandDebounce(0)
+			t.Cleanup(func() {
+				util.ResetCache()
+				util.SetCommandDebounce(util.DefaultCommandDebounce)
+			})
+			l := logrus.New()
+			l.SetOutput(io.Discard)
+			log := logrus.NewEntry(l)
+
+			ac := &natureremo.Appliance{
+				ID:             "aircon",
+				Nickname:       "AirCon",
+				AirConSettings: &natureremo.AirConSettings{Temperature: tt.current},
+			}
+			nr := naturefake.NewClient(nil, []*natureremo.Appliance{ac})
+
+			c, err := tt.new(log, &natureremo.AirConRangeMode{Temperature: tt.temps}, nr, ac)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("err = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.MinValue() != tt.min || c.MaxValue() != tt.max || c.StepValue() != tt.step {
+				t.Errorf("range = %g~%g(%g), want %g~%g(%g)", c.MinValue(), c.MaxValue(), c.StepValue(), tt.min, tt.max, tt.step)
+			}
+			current, _ := strconv.ParseFloat(tt.current, 64)
+			if got := c.Value(); got != current {
+				t.Errorf("initial value = %g, want %g", got, current)
+			}
+			if got, status := c.ValueRequest(nil); status != 0 || got != current {
+				t.Errorf("value = %v(%d), want %g", got, status, current)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+			if _, status := c.SetValueRequest(tt.write, req); status != 0 {
+				t.Fatalf("status = %d", status)
+			}
+			cmds := nr.Commands()
+			if len(cmds) != 1 || cmds[0].AirConSettings == nil || cmds[0].AirConSettings.Temperature != tt.sent {
+				t.Fatalf("commands = %+v, want temperature %s", cmds, tt.sent)
+			}
+
+			// 取得し直した家電の設定温度を返す
+			util.ResetCache()
+			if got, status := c.ValueRequest(req); status != 0 || got != tt.write {
+				t.Errorf("value = %v(%d), want %g", got, status, tt.write)
+			}
+		})
+	}
+}
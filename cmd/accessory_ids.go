@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/brutella/hap"
+)
+
+// Nature の ID と HAP のアクセサリー ID の対応を保存する fsStore のキー
+const accessoryIDsKey = "nature-accessory-ids"
+
+// ブリッジ自身のアクセサリー ID
+const bridgeAccessoryID = 1
+
+// Nature のデバイス・家電ごとにアクセサリー ID を割り当てる関数
+// 家電の追加・削除で並び順が変わっても Home アプリ上の部屋やオートメーションの設定が外れないよう、
+// 一度割り当てた ID は保存しておき、削除された家電の ID も再利用しない
+// (対応がまだ保存されていない場合は、これまでと同じく並び順で割り当てる)
+func assignAccessoryIDs(store hap.Store, accessories []natureAccessory) error {
+	ids := map[string]uint64{}
+	if b, err := store.Get(accessoryIDsKey); err == nil {
+		if err := json.Unmarshal(b, &ids); err != nil {
+			log.Warnf("Saved accessory IDs are broken: %s", err)
+			ids = map[string]uint64{}
+		}
+	}
+
+	next := uint64(bridgeAccessoryID + 1)
+	for _, id := range ids {
+		if id >= next {
+			next = id + 1
+		}
+	}
+
+	changed := false
+	for _, na := range accessories {
+		id, found := ids[na.ID]
+		if !found {
+			id = next
+			next++
+			ids[na.ID] = id
+			changed = true
+			log.Debugf("Assign accessory ID %d: %s(%s)", id, na.Name(), na.ID)
+		}
+		na.Id = id
+	}
+
+	if !changed {
+		return nil
+	}
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return store.Set(accessoryIDsKey, b)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+)
+
+func newNatureAccessories(ids ...string) []natureAccessory {
+	var accessories []natureAccessory
+	for _, id := range ids {
+		accessories = append(accessories, natureAccessory{ID: id, A: accessory.New(accessory.Info{Name: id}, accessory.TypeOther)})
+	}
+	return accessories
+}
+
+// 家電の追加・削除で並び順が変わっても、一度割り当てた ID は変わらず、削除された家電の ID も再利用しない
+func TestAssignAccessoryIDs(t *testing.T) {
+	dir := t.TempDir()
+	assign := func(ids ...string) map[string]uint64 {
+		t.Helper()
+		// 再起動と同じく、毎回 fsStore を開き直す
+		accessories := newNatureAccessories(ids...)
+		if err := assignAccessoryIDs(hap.NewFsStore(dir), accessories); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]uint64{}
+		for _, na := range accessories {
+			got[na.ID] = na.Id
+		}
+		return got
+	}
+
+	steps := []struct {
+		name string
+		ids  []string
+		want map[string]uint64
+	}{
+		{name: "assign", ids: []string{"aircon", "fan", "light"}, want: map[string]uint64{"aircon": 2, "fan": 3, "light": 4}},
+		{name: "remove", ids: []string{"aircon", "light"}, want: map[string]uint64{"aircon": 2, "light": 4}},
+		{name: "add new one before others", ids: []string{"blind", "aircon", "light"}, want: map[string]uint64{"blind": 5, "aircon": 2, "light": 4}},
+		{name: "re-add removed one", ids: []string{"fan", "light", "aircon", "blind"}, want: map[string]uint64{"fan": 3, "light": 4, "aircon": 2, "blind": 5}},
+	}
+	for _, step := range steps {
+		got := assign(step.ids...)
+		for id, want := range step.want {
+			if got[id] != want {
+				t.Errorf("%s: %s = %d, want %d", step.name, id, got[id], want)
+			}
+		}
+	}
+}
+
+// 保存した対応が壊れている場合は、並び順で割り当て直す
+func TestAssignAccessoryIDsBroken(t *testing.T) {
+	store := hap.NewFsStore(t.TempDir())
+	if err := store.Set(accessoryIDsKey, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	accessories := newNatureAccessories("aircon", "fan")
+	if err := assignAccessoryIDs(store, accessories); err != nil {
+		t.Fatal(err)
+	}
+	if accessories[0].Id != 2 || accessories[1].Id != 3 {
+		t.Errorf("ids = %d, %d, want 2, 3", accessories[0].Id, accessories[1].Id)
+	}
+}
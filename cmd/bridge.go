@@ -0,0 +1,661 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/legnoh/hap-nature-remo/additionalaccessory"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+type A []*accessory.A
+
+// Nature のデバイス・家電と、それから作ったアクセサリーの組
+type natureAccessory struct {
+	// Nature のデバイス ID または家電 ID
+	ID string
+	*accessory.A
+}
+
+// アクセサリーを作れなかったデバイス・家電
+type accessoryFailure struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+// HAP サーバーと、Nature の一覧から作ったアクセサリーをまとめて管理するもの
+// (一覧が変わった場合はアクセサリーを作り直し、HAP サーバーを再起動する)
+type Bridge struct {
+	// HAP サーバーの待ち受けアドレス(空の場合は空いているポート)
+	Addr string
+
+	conf    Config
+	nr      util.NatureClient
+	store   hap.Store
+	snap    *snapshot
+	restart chan struct{}
+	refresh chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+
+	// 一覧の変更と設定の再読み込みで、同時にアクセサリーを作り直さないようにする
+	rebuildMu sync.Mutex
+
+	mu          sync.Mutex
+	server      *hap.Server
+	inv         Inventory
+	accessories []natureAccessory
+	failures    []accessoryFailure
+	restored    bool
+
+	// センサーの値の補正(全てのアクセサリーで共有し、設定を読み込み直した時は作り直さずに差し替える)
+	calibrations *additionalaccessory.Calibrations
+}
+
+// 設定と Nature API の情報からブリッジと配下のアクセサリーを組み立てる関数
+// 前回保存した一覧があれば、startup_retry_timeout(デフォルトは0で待たない)の間だけ Nature API を待ってから保存した一覧でアクセサリーを作り、
+// 最新の一覧はバックグラウンドで取得する
+// (保存した一覧がなく Nature API にも接続できない場合は、接続できるか ctx がキャンセルされるまで待つ)
+func NewBridge(ctx context.Context, c Config, nr util.NatureClient, store hap.Store) (*Bridge, error) {
+
+	// 保存した一覧は Nature API に接続できない場合に使い、値は接続できた場合も引き継ぐ
+	saved, found := restoreInventory(store)
+	var fallback *Inventory
+	if found {
+		fallback = &saved
+	}
+	inv, restored, err := loadInventory(ctx, nr, fallback, c.StartupRetryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	values := saved.Values
+	if !restored {
+		values = withoutCloudState(inv, values)
+	}
+
+	b := &Bridge{
+		conf:     c,
+		nr:       nr,
+		store:    store,
+		restart:  make(chan struct{}, 1),
+		refresh:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		restored: restored,
+
+		calibrations: additionalaccessory.NewCalibrations(nil),
+	}
+	server, accessories, failures, err := b.build(inv, values)
+	if err != nil {
+		return nil, err
+	}
+	b.server = server
+	b.inv = inv
+	b.accessories = accessories
+	b.failures = failures
+
+	b.snap = newSnapshot(store, inv, accessories)
+	if err := b.snap.save(); err != nil {
+		log.Warnf("Failed to save Nature inventory: %s", err)
+	}
+	return b, nil
+}
+
+func (b *Bridge) config() Config {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf
+}
+
+// 一覧からアクセサリーを作り、HAP サーバーを作る
+// (作れなかったデバイス・家電は警告を出して飛ばし、他のアクセサリーだけで HAP サーバーを作る)
+func (b *Bridge) build(inv Inventory, values map[string]map[string]interface{}) (*hap.Server, []natureAccessory, []accessoryFailure, error) {
+
+	c := b.config()
+
+	// ブリッジ作成
+	bridge := accessory.NewBridge(accessory.Info{
+		Name:         c.Name,
+		Manufacturer: "@legnoh",
+		Model:        version,
+	})
+	bridge.Id = bridgeAccessoryID
+
+	opts, err := newAccessoryOptions(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	b.calibrations.Set(opts.sensors.calibrations(inv.Devices))
+	opts.calibrations = b.calibrations
+	accessories, failures := buildAccessories(b.nr, inv, opts, nil)
+	for _, f := range failures {
+		log.Warnf("Skipped accessory %s(%s). Will retry on next inventory refresh: %s", f.Name, f.ID, f.Err)
+	}
+	restoreValues(accessories, values)
+	for _, na := range accessories {
+		rejectWritesOnShutdown(na.A)
+	}
+	if err := assignAccessoryIDs(b.store, accessories); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var as A
+	for _, na := range accessories {
+		as = append(as, na.A)
+	}
+	server, err := hap.NewServer(b.store, bridge.A, as...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	server.Pin = c.Pin
+	flushPairVerify(server)
+	return server, accessories, failures, nil
+}
+
+// HAP サーバーを起動する関数
+// (ctx がキャンセルされるか Shutdown が呼ばれるまで、一覧の変更に合わせてアクセサリーを作り直しながら動き続ける)
+// 止まる際は、最後の一覧とアクセサリーの値を保存する
+func (b *Bridge) ListenAndServe(ctx context.Context) error {
+
+	ctx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+
+	// 一覧の取得に成功するたびに保存し直す
+	stop := util.OnRefresh(b.snap.refresh)
+	defer stop()
+
+	defer func() {
+		if err := b.snap.save(); err != nil {
+			log.Warnf("Failed to save Nature inventory: %s", err)
+		}
+	}()
+
+	go b.watchInventory(ctx)
+
+	for {
+		b.mu.Lock()
+		server := b.server
+		server.Addr = b.Addr
+		b.mu.Unlock()
+
+		serverCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- server.ListenAndServe(serverCtx)
+		}()
+
+		select {
+		case err := <-done:
+			cancel()
+			return err
+		case <-b.stop:
+			cancel()
+			<-done
+			log.Info("HAP Server stopped")
+			return nil
+		case <-b.restart:
+			cancel()
+			<-done
+			log.Info("Restarting HAP Server with updated accessories...")
+		}
+	}
+}
+
+// ブリッジを止める関数
+// Home アプリからの新しい操作は受け付けずに、送信待ちのコマンドを ctx が終わるまで送り続け、
+// 送り切るか ctx が終わったら HAP サーバーを止める(送信できなかったコマンドはログに出す)
+func (b *Bridge) Shutdown(ctx context.Context) {
+	log.Info("Sending queued commands before shutdown...")
+	for _, cmd := range util.DrainCommands(ctx) {
+		log.Warnf("Command was not delivered: %s", cmd)
+	}
+	b.once.Do(func() {
+		close(b.stop)
+	})
+}
+
+// 定期的に一覧を取得し直し、変更があればアクセサリーを作り直す
+func (b *Bridge) watchInventory(ctx context.Context) {
+
+	// 保存した一覧で起動した場合は、最新の一覧が取れるまでリトライする
+	if b.restored {
+		inv, _, err := loadInventory(ctx, b.nr, nil, 0)
+		if err != nil {
+			return
+		}
+		log.Info("Got latest Nature inventory")
+		b.update(inv)
+	}
+
+	for {
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if interval := b.config().InventoryInterval; interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.refresh:
+		case <-tick:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		inv, err := fetchInventory(ctx, b.nr)
+		if err != nil {
+			log.Warnf("Failed to get Nature inventory: %s", err)
+			continue
+		}
+		b.update(inv)
+	}
+}
+
+// 取得し直した一覧を反映する
+// (アクセサリーに関わる変更があった場合は、クラウドに状態がない家電の値だけを引き継いでアクセサリーを作り直す)
+func (b *Bridge) update(inv Inventory) {
+	b.rebuildMu.Lock()
+	defer b.rebuildMu.Unlock()
+
+	b.mu.Lock()
+	old := b.inv
+	b.mu.Unlock()
+
+	diff := diffInventory(old, inv, b.config().Appliances)
+	if diff.empty() && !b.retryable(inv) {
+		b.mu.Lock()
+		b.inv = inv
+		b.mu.Unlock()
+		b.snap.replace(inv)
+		return
+	}
+	for _, name := range diff.Added {
+		log.Infof("Nature inventory added: %s", name)
+	}
+	for _, name := range diff.Removed {
+		log.Infof("Nature inventory removed: %s", name)
+	}
+	for _, name := range diff.Changed {
+		log.Infof("Nature inventory changed: %s", name)
+	}
+
+	b.rebuild(inv, withoutCloudState(inv, b.snap.values()))
+}
+
+// 前回作れなかったアクセサリーが、最新の一覧で作れるようになったかどうか
+// (試しに作ったアクセサリーはすぐに捨てる)
+func (b *Bridge) retryable(inv Inventory) bool {
+	b.mu.Lock()
+	failed := map[string]bool{}
+	for _, f := range b.failures {
+		failed[f.ID] = true
+	}
+	b.mu.Unlock()
+	if len(failed) == 0 {
+		return false
+	}
+
+	opts, err := newAccessoryOptions(b.config())
+	if err != nil {
+		return false
+	}
+	accessories, failures := buildAccessories(b.nr, inv, opts, failed)
+	for _, na := range accessories {
+		log.Infof("Accessory is now available: %s(%s)", na.Name(), na.ID)
+		additionalaccessory.Release(na.A)
+	}
+	for _, f := range failures {
+		log.Debugf("Accessory is still unavailable: %s(%s): %s", f.Name, f.ID, f.Err)
+	}
+	return len(accessories) != 0
+}
+
+// values の値を引き継いでアクセサリーを作り直し、HAP サーバーを再起動する
+func (b *Bridge) rebuild(inv Inventory, values map[string]map[string]interface{}) {
+	server, accessories, failures, err := b.build(inv, values)
+	if err != nil {
+		log.Errorf("Failed to rebuild accessories: %s", err)
+		return
+	}
+
+	b.mu.Lock()
+	for _, na := range b.accessories {
+		additionalaccessory.Release(na.A)
+	}
+	b.server = server
+	b.inv = inv
+	b.accessories = accessories
+	b.failures = failures
+	b.mu.Unlock()
+	b.snap.reset(inv, accessories)
+
+	select {
+	case b.restart <- struct{}{}:
+	default:
+	}
+}
+
+// 読み込み直した設定を反映する関数
+// 家電の名前とセンサーの値の補正は、アクセサリーを作り直さずにそのまま反映する
+// (ブリッジの名前・PIN が変わった場合と、設定の変更で作り方が変わるアクセサリーがある場合のみ、アクセサリーを作り直して HAP サーバーを再起動する)
+func (b *Bridge) Reload(c Config) {
+	b.rebuildMu.Lock()
+	defer b.rebuildMu.Unlock()
+
+	b.mu.Lock()
+	old := b.conf
+	b.conf = c
+	inv := b.inv
+	b.mu.Unlock()
+
+	// アカウントが変わった可能性があるため、すぐに一覧を取得し直す
+	// (アクセストークンを変えた時のキャッシュは、呼び出し側で捨てておく)
+	if old.Token != c.Token || old.InventoryInterval != c.InventoryInterval {
+		select {
+		case b.refresh <- struct{}{}:
+		default:
+		}
+	}
+	if old.Name != c.Name || old.Pin != c.Pin {
+		log.Info("Rebuilding accessories with new name/pin...")
+		b.rebuild(inv, b.snap.values())
+		return
+	}
+
+	// hap.Server は起動後にアクセサリーを差し替えられず、同じアクセサリーを別の HAP サーバーに渡すと変更の通知が重複するため、
+	// 作り方が変わるアクセサリーがある場合は、今の値を引き継いで全てを作り直す
+	names, err := affectedAccessories(inv, old, c)
+	if err != nil {
+		log.Errorf("Failed to apply new config: %s", err)
+		return
+	}
+	if len(names) != 0 {
+		for _, name := range names {
+			log.Infof("Accessory config changed: %s", name)
+		}
+		b.rebuild(inv, b.snap.values())
+		return
+	}
+
+	b.calibrations.Set(sensorOverrides(c.Sensors).calibrations(inv.Devices))
+	b.mu.Lock()
+	accessories := b.accessories
+	b.mu.Unlock()
+	for id, name := range applianceNames(inv, c) {
+		for _, na := range accessories {
+			if na.ID == id && na.Name() != name {
+				log.Infof("Accessory renamed: %s -> %s", na.Name(), name)
+				na.Info.Name.SetValue(name)
+			}
+		}
+	}
+}
+
+// 終了処理中は、Home アプリからの操作を通信障害として断る
+// (値を書き換えてから送信に失敗すると、Home アプリでは操作が成功したように見えるため、値を書き換える前に断る)
+func rejectWritesOnShutdown(a *accessory.A) {
+	for _, s := range a.Ss {
+		for _, c := range s.Cs {
+			if !c.IsWritable() {
+				continue
+			}
+			next := c.SetValueRequestFunc
+			c.SetValueRequestFunc = func(v interface{}, r *http.Request) (interface{}, int) {
+				if util.ShuttingDown() {
+					log.Warnf("Rejected request to %s while shutting down", a.Info.Name.Value())
+					return nil, hap.JsonStatusServiceCommunicationFailure
+				}
+				if next != nil {
+					return next(v, r)
+				}
+				return nil, 0
+			}
+		}
+	}
+}
+
+// 家電 ID ごとの、Home アプリでの名前(上書き設定がなければニックネーム)
+func applianceNames(inv Inventory, c Config) map[string]string {
+	names := map[string]string{}
+	for _, appliance := range inv.Appliances {
+		names[appliance.ID] = appliance.Nickname
+		if o, found := applianceOverrides(c.Appliances).lookup(appliance); found && o.Name != "" {
+			names[appliance.ID] = o.Name
+		}
+	}
+	return names
+}
+
+// 設定の変更で、作り方が変わるデバイス・家電の名前
+// (フィルタ・上書き設定・センサーの設定を、デバイス・家電ごとに比べる)
+func affectedAccessories(inv Inventory, old, new Config) ([]string, error) {
+	oldOpts, err := newAccessoryOptions(old)
+	if err != nil {
+		return nil, err
+	}
+	newOpts, err := newAccessoryOptions(new)
+	if err != nil {
+		return nil, err
+	}
+	before, after := accessorySettings(inv, oldOpts), accessorySettings(inv, newOpts)
+
+	var names []string
+	for _, device := range inv.Devices {
+		if !reflect.DeepEqual(before[device.ID], after[device.ID]) {
+			names = append(names, device.Name)
+		}
+	}
+	for _, appliance := range inv.Appliances {
+		if !reflect.DeepEqual(before[appliance.ID], after[appliance.ID]) {
+			names = append(names, appliance.Nickname)
+		}
+	}
+	return names, nil
+}
+
+// アクセサリーの作り方を決める設定
+// (家電の名前と温度・湿度の補正は作り直さずに反映できるため含めない。照度の変換表は値の範囲が変わるため含める)
+type accessorySetting struct {
+	Kind     string
+	Override interface{}
+}
+
+// デバイス・家電 ID ごとのアクセサリーの作り方(フィルタで除くもの・登録しないものは含めない)
+func accessorySettings(inv Inventory, opts accessoryOptions) map[string]accessorySetting {
+	settings := map[string]accessorySetting{}
+	for _, device := range inv.Devices {
+		if !isSensor(device) || !opts.filter.allow(sensorTarget(device)) {
+			continue
+		}
+		so, _ := opts.sensors.lookup(device)
+		so.Temperature, so.Humidity = additionalaccessory.Calibration{}, additionalaccessory.Calibration{}
+		settings[device.ID] = accessorySetting{Kind: accessoryTypeSensor, Override: so}
+	}
+	for _, appliance := range inv.Appliances {
+		kind := applianceKind(appliance, opts.overrides)
+		if kind == "" || !opts.filter.allow(applianceTarget(appliance, kind)) {
+			continue
+		}
+		o, _ := opts.overrides.lookup(appliance)
+		o.Name = ""
+		settings[appliance.ID] = accessorySetting{Kind: kind, Override: o}
+	}
+	return settings
+}
+
+// センサーとして登録するデバイスかどうか
+func isSensor(device *natureremo.Device) bool {
+	return len(device.NewestEvents) != 0
+}
+
+// リモコン式ファンとして登録する家電かどうか
+func isFan(appliance *natureremo.Appliance) bool {
+	return appliance.Type == natureremo.ApplianceTypeIR && appliance.Image == "ico_fan"
+}
+
+// エアコンとして登録する家電かどうか
+func isAirConditioner(appliance *natureremo.Appliance) bool {
+	return appliance.Type == natureremo.ApplianceTypeAirCon
+}
+
+// 設定から決まる、アクセサリーの作り方
+type accessoryOptions struct {
+	filter    accessoryFilter
+	overrides applianceOverrides
+	sensors   sensorOverrides
+	// アクセサリーで共有するセンサーの値の補正(nil の場合は sensors から作る)
+	calibrations *additionalaccessory.Calibrations
+}
+
+func newAccessoryOptions(c Config) (accessoryOptions, error) {
+	filter, err := newAccessoryFilter(c.Include, c.Exclude)
+	if err != nil {
+		return accessoryOptions{}, err
+	}
+	return accessoryOptions{filter: filter, overrides: c.Appliances, sensors: c.Sensors}, nil
+}
+
+// Nature のデバイス・家電から、HomeKit で操作可能なアクセサリーを作る関数
+// 作れなかったデバイス・家電は、他のアクセサリーに影響しないよう飛ばして返す
+// フィルタで除いたものは作らない(only を指定した場合は、その ID のデバイス・家電だけを作る)
+func buildAccessories(nr util.NatureClient, inv Inventory, opts accessoryOptions, only map[string]bool) ([]natureAccessory, []accessoryFailure) {
+
+	var accessories []natureAccessory
+	var failures []accessoryFailure
+	cals := opts.calibrations
+	if cals == nil {
+		cals = additionalaccessory.NewCalibrations(opts.sensors.calibrations(inv.Devices))
+	}
+	// 作り直せるか試すだけの場合は、見つけた旨のログを出さない
+	level := logrus.InfoLevel
+	if only != nil {
+		level = logrus.DebugLevel
+	}
+	add := func(t filterTarget, log *logrus.Entry, fn func() (*accessory.A, error)) {
+		if !opts.filter.allow(t) {
+			log.Logf(level, "Excluded by filter: %s(%s)", t.Name, t.ID)
+			return
+		}
+		a, err := newAccessory(fn)
+		if err != nil {
+			failures = append(failures, accessoryFailure{ID: t.ID, Name: t.Name, Err: err})
+			return
+		}
+		accessories = append(accessories, natureAccessory{t.ID, a})
+	}
+
+	// センサーが1つでもあった場合はSensorアプライアンスを作る
+	for _, device := range inv.Devices {
+		if only != nil && !only[device.ID] {
+			continue
+		}
+		if isSensor(device) {
+			log := deviceLogger(device)
+			log.Logf(level, "Sensor device detected: %s", device.Name)
+			add(sensorTarget(device), log, func() (*accessory.A, error) {
+				so, _ := opts.sensors.lookup(device)
+				a, err := additionalaccessory.NewSensor(log, nr, device, so.options(cals))
+				return a.A, err
+			})
+		}
+	}
+
+	// NatureRemoに登録済の家電一覧を取得し、全ての家電から操作可能なものを登録していく
+	// (上書き設定で扱い方を指定した家電は、その種類のアクセサリーにする)
+	for _, appliance := range inv.Appliances {
+		if only != nil && !only[appliance.ID] {
+			continue
+		}
+		kind := applianceKind(appliance, opts.overrides)
+		if kind == "" {
+			continue
+		}
+		o, _ := opts.overrides.lookup(appliance)
+		log := applianceLogger(appliance)
+		log.Logf(level, "Compatible Appliance Found: %s(%s)", appliance.Nickname, appliance.ID)
+		add(applianceTarget(appliance, kind), log, func() (*accessory.A, error) {
+			a, err := newApplianceAccessory(log, nr, inv, appliance, kind, o, cals)
+			if err != nil {
+				return nil, err
+			}
+			applyOverride(a, o)
+			return a, nil
+		})
+	}
+	return accessories, failures
+}
+
+// 家電から、指定した種類のアクセサリーを作る
+func newApplianceAccessory(log *logrus.Entry, nr util.NatureClient, inv Inventory, appliance *natureremo.Appliance, kind string, o ApplianceOverride, cals *additionalaccessory.Calibrations) (*accessory.A, error) {
+	signals := applianceSignals(inv, appliance)
+	switch kind {
+
+	// リモコン式ファンがある場合はFanアプライアンスを作る
+	case accessoryTypeFan:
+		fs, err := overrideFanSignals(appliance, signals, o)
+		if err != nil {
+			return nil, err
+		}
+		a, err := additionalaccessory.NewFanWithSignals(log, nr, appliance, fs)
+		return a.A, err
+
+	// エアコン(NatureRemo対応のもの)がある場合はAirConditionerアプライアンスを作る
+	case accessoryTypeAirConditioner:
+		ids, err := overrideTemperatureSensors(appliance, inv.Devices, o)
+		if err != nil {
+			return nil, err
+		}
+		a, err := additionalaccessory.NewAirConditioner(log, nr, appliance, inv.Devices, additionalaccessory.AirConditionerOptions{
+			TemperatureSensors: ids,
+			Calibrations:       cals,
+		})
+		return a.A, err
+
+	case accessoryTypeWindowCovering:
+		actions, err := overrideSignals(appliance, signals, o)
+		if err != nil {
+			return nil, err
+		}
+		a, err := additionalaccessory.NewWindowCovering(log, nr, appliance, actions["open"], actions["close"])
+		return a.A, err
+
+	case accessoryTypeSwitch:
+		ss, err := overrideSwitchSignals(appliance, signals, o)
+		if err != nil {
+			return nil, err
+		}
+		a, err := additionalaccessory.NewSwitch(log, nr, appliance, ss)
+		return a.A, err
+	}
+	return nil, fmt.Errorf("%s: %w: unknown type %s", appliance.Nickname, additionalaccessory.ErrUnsupported, kind)
+}
+
+// センサーのアクセサリーが使うロガー(デバイス ID と名前をつける)
+func deviceLogger(device *natureremo.Device) *logrus.Entry {
+	return util.Logger(util.ComponentAccessory).WithFields(logrus.Fields{"device_id": device.ID, "device": device.Name})
+}
+
+// 家電のアクセサリーが使うロガー(家電 ID とニックネームをつける)
+func applianceLogger(appliance *natureremo.Appliance) *logrus.Entry {
+	return util.Logger(util.ComponentAccessory).WithFields(logrus.Fields{"appliance_id": appliance.ID, "nickname": appliance.Nickname})
+}
+
+// 1つのデバイス・家電からアクセサリーを作る
+// (想定外のデータで panic した場合も、そのデバイス・家電だけの失敗として扱う)
+func newAccessory(fn func() (*accessory.A, error)) (a *accessory.A, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/legnoh/hap-nature-remo/additionalaccessory"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestAffectedAccessories(t *testing.T) {
+	remo := &natureremo.Device{
+		DeviceCore:   natureremo.DeviceCore{ID: "remo", Name: "Living"},
+		NewestEvents: map[natureremo.SensorType]natureremo.SensorValue{natureremo.SensorTypeTemperature: {Value: 24}},
+	}
+	inv := Inventory{
+		Devices: []*natureremo.Device{remo},
+		Appliances: []*natureremo.Appliance{
+			{ID: "aircon", Nickname: "Aircon", Type: natureremo.ApplianceTypeAirCon, Device: &remo.DeviceCore},
+			{ID: "fan", Nickname: "Fan", Type: natureremo.ApplianceTypeIR, Image: "ico_fan", Device: &remo.DeviceCore},
+			{ID: "light", Nickname: "Light", Type: natureremo.ApplianceTypeIR, Image: "ico_light", Device: &remo.DeviceCore},
+		},
+	}
+	base := Config{Name: "Bridge", Pin: "00102003"}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{name: "nothing", change: func(c *Config) {}},
+		{name: "unrelated setting", change: func(c *Config) { c.CacheTTL = time.Minute }},
+		{name: "exclude one", change: func(c *Config) { c.Exclude = []FilterRule{{ID: "fan"}} }, want: []string{"Fan"}},
+		{name: "override name", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"Fan": {Name: "Ceiling Fan"}}
+		}},
+		{name: "override model", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"Fan": {Model: "F-1"}}
+		}, want: []string{"Fan"}},
+		{name: "override type", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"light": {Type: accessoryTypeSwitch}}
+		}, want: []string{"Light"}},
+		{name: "override of unregistered appliance", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"light": {Name: "Lamp"}}
+		}},
+		{name: "sensor calibration", change: func(c *Config) {
+			c.Sensors = map[string]SensorOverride{"remo": {Temperature: additionalaccessory.Calibration{Offset: -1}}}
+		}},
+		{name: "illuminance table", change: func(c *Config) {
+			c.Sensors = map[string]SensorOverride{"remo": {Illuminance: []additionalaccessory.LuxPoint{{Value: 0, Lux: 0}, {Value: 200, Lux: 1000}}}}
+		}, want: []string{"Living"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			tt.change(&c)
+			got, err := affectedAccessories(inv, base, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("affected = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 家電の名前とセンサーの補正の変更は、HAP サーバーを再起動せずに反映する
+func TestReloadAppliesLive(t *testing.T) {
+	util.ResetCache()
+	t.Cleanup(util.ResetCache)
+	remo := &natureremo.Device{
+		DeviceCore:   natureremo.DeviceCore{ID: "remo", Name: "Living"},
+		NewestEvents: map[natureremo.SensorType]natureremo.SensorValue{natureremo.SensorTypeTemperature: {Value: 24, CreatedAt: time.Now()}},
+	}
+	light := &natureremo.Appliance{
+		ID: "light", Nickname: "Light", Type: natureremo.ApplianceTypeIR, Device: &remo.DeviceCore,
+		Signals: []*natureremo.Signal{{ID: "power", Name: "Power"}},
+	}
+	nr := naturefake.NewClient([]*natureremo.Device{remo}, []*natureremo.Appliance{light})
+	base := Config{Name: "Bridge", Pin: "00102003", Appliances: map[string]ApplianceOverride{"light": {Type: accessoryTypeSwitch}}}
+
+	b, err := NewBridge(context.Background(), base, nr, hap.NewMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := b.server
+
+	c := base
+	c.Appliances = map[string]ApplianceOverride{"light": {Type: accessoryTypeSwitch, Name: "Lamp"}}
+	c.Sensors = map[string]SensorOverride{"living": {Temperature: additionalaccessory.Calibration{Offset: -1}}}
+	b.Reload(c)
+
+	if b.server != server {
+		t.Error("HAP server was rebuilt")
+	}
+	checked := 0
+	for _, na := range b.accessories {
+		switch na.ID {
+		case "light":
+			if got := na.Name(); got != "Lamp" {
+				t.Errorf("light name = %s, want Lamp", got)
+			}
+		case "remo":
+			for _, s := range na.Ss {
+				for _, ch := range s.Cs {
+					if ch.Type != characteristic.TypeCurrentTemperature {
+						continue
+					}
+					checked++
+					if got, status := ch.ValueRequest(nil); status != 0 || got != 23.0 {
+						t.Errorf("temperature = %v(%d), want 23", got, status)
+					}
+				}
+			}
+		}
+	}
+	if checked != 1 {
+		t.Errorf("temperature sensor was not found")
+	}
+}
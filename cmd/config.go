@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/legnoh/hap-nature-remo/additionalaccessory"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tenntenn/natureremo"
+)
+
+var printSchema bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "manage config file",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "validate config file against the schema and Nature API",
+	Long: `Validate config file strictly. Unknown keys are reported as errors.
+The access token is checked against Nature API, and appliances/devices referenced
+in include, exclude, appliances and sensors are checked to exist.
+With --schema, print JSON Schema of config file for editor autocompletion instead.`,
+	Args: cobra.NoArgs,
+	Run:  validateConfig,
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	confDir = home + "/.hap-nature-remo"
+
+	configValidateCmd.Flags().StringVarP(&cfgFile, "config", "c", confDir+"/config.yml", "config file path")
+	configValidateCmd.Flags().BoolVar(&printSchema, "schema", false, "print JSON Schema of config file and exit")
+}
+
+func validateConfig(cmd *cobra.Command, args []string) {
+	if printSchema {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(configSchema()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	viper.SetConfigFile(cfgFile)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	// 書き間違えたキーが無視されないよう、未知のキーをエラーにする
+	if err := viper.UnmarshalExact(&Config{}); err != nil {
+		log.Fatalf("Your config has unknown or invalid keys: %s", err)
+	}
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.Token == "" {
+		log.Fatal("Your token is empty. Please set an access token issued at https://home.nature.global")
+	}
+	applyConfig(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.APITimeout*time.Duration(c.APIRetries+2))
+	defer cancel()
+
+	nr := util.NewClient(c.Token, c.RateLimitReserve)
+	if c.APIBaseURL != "" {
+		nr.BaseURL = c.APIBaseURL
+	}
+	user, err := nr.UserService.Me(ctx)
+	if err != nil {
+		var apiErr *natureremo.APIError
+		if errors.As(err, &apiErr) && apiErr.HTTPStatus == http.StatusUnauthorized {
+			log.Fatal("Your token was rejected by Nature API. Please check the access token")
+		}
+		log.Fatalf("Failed to check your token with Nature API: %s", err)
+	}
+	log.Infof("Token is valid: %s", user.Nickname)
+
+	inv, err := fetchInventory(ctx, nr)
+	if err != nil {
+		log.Fatalf("Failed to get Nature inventory: %s", err)
+	}
+	problems := configReferences(c, inv)
+	for _, p := range problems {
+		log.Error(p)
+	}
+	if len(problems) != 0 {
+		log.Fatalf("Your config has %d problem(s): %s", len(problems), cfgFile)
+	}
+	log.Infof("Config is valid: %s", cfgFile)
+}
+
+// 設定で参照しているデバイス・家電・信号が、 Nature に登録されているかを確認する関数
+func configReferences(c Config, inv Inventory) []string {
+	var problems []string
+
+	ids := map[string]bool{}
+	for _, device := range inv.Devices {
+		ids[device.ID] = true
+	}
+	for _, appliance := range inv.Appliances {
+		ids[appliance.ID] = true
+	}
+	for key, rules := range map[string][]FilterRule{"include": c.Include, "exclude": c.Exclude} {
+		for i, rule := range rules {
+			if rule.ID != "" && !ids[rule.ID] {
+				problems = append(problems, fmt.Sprintf("%s[%d].id(%s) was not found", key, i, rule.ID))
+			}
+		}
+	}
+
+	for key, o := range c.Appliances {
+		i := slices.IndexFunc(inv.Appliances, func(a *natureremo.Appliance) bool {
+			_, found := applianceOverrides{key: o}.lookup(a)
+			return found
+		})
+		if i < 0 {
+			problems = append(problems, fmt.Sprintf("appliances.%s: appliance was not found", key))
+			continue
+		}
+		appliance := inv.Appliances[i]
+		if _, err := overrideSignals(appliance, applianceSignals(inv, appliance), o); err != nil {
+			problems = append(problems, fmt.Sprintf("appliances.%s: %s", key, err))
+		}
+		if len(o.TemperatureSensors) != 0 && !isAirConditioner(appliance) {
+			problems = append(problems, fmt.Sprintf("appliances.%s.temperature_sensors: %s is not an air conditioner", key, appliance.Nickname))
+		}
+		if _, err := overrideTemperatureSensors(appliance, inv.Devices, o); err != nil {
+			problems = append(problems, fmt.Sprintf("appliances.%s.temperature_sensors: %s", key, err))
+		}
+	}
+
+	for key, o := range c.Sensors {
+		found := slices.ContainsFunc(inv.Devices, func(d *natureremo.Device) bool {
+			_, found := sensorOverrides{key: o}.lookup(d)
+			return found
+		})
+		if !found {
+			problems = append(problems, fmt.Sprintf("sensors.%s: device was not found", key))
+		}
+	}
+
+	slices.Sort(problems)
+	return problems
+}
+
+// JSON Schema の enum にする、決まった値しか取らない設定
+var schemaEnums = map[string][]string{
+	"FilterRule.Type":              {accessoryTypeSensor, accessoryTypeFan, accessoryTypeAirConditioner, accessoryTypeWindowCovering, accessoryTypeSwitch},
+	"ApplianceOverride.Type":       {accessoryTypeFan, accessoryTypeWindowCovering, accessoryTypeSwitch},
+	"ApplianceOverride.Category":   categoryNames(),
+	"SensorOverride.MotionService": {additionalaccessory.MotionServiceMotion, additionalaccessory.MotionServiceOccupancy, additionalaccessory.MotionServiceBoth},
+}
+
+// 設定ファイルの JSON Schema を Config から作る関数
+func configSchema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(Config{}))
+	s["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	s["title"] = "hap-nature-remo config"
+
+	// log_levels はまとまりごとのログレベル
+	levels := s["properties"].(map[string]interface{})["log_levels"].(map[string]interface{})
+	var names []string
+	for _, l := range logrus.AllLevels {
+		names = append(names, l.String())
+	}
+	levels["propertyNames"] = map[string]interface{}{"enum": util.LogComponents()}
+	levels["additionalProperties"] = map[string]interface{}{"type": "string", "enum": names}
+	return s
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return map[string]interface{}{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+			if key == "" {
+				key = strings.ToLower(f.Name)
+			}
+			s := typeSchema(f.Type)
+			if enum, found := schemaEnums[t.Name()+"."+f.Name]; found {
+				s["enum"] = enum
+			}
+			if d, found := f.Tag.Lookup("default"); found {
+				s["default"] = schemaDefault(f.Type, d)
+			}
+			props[key] = s
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+// default タグの値を JSON の型に合わせる
+func schemaDefault(t reflect.Type, d string) interface{} {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return d
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v, err := strconv.ParseInt(d, 10, 64); err == nil {
+			return v
+		}
+	case reflect.Bool:
+		if v, err := strconv.ParseBool(d); err == nil {
+			return v
+		}
+	}
+	return d
+}
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+)
+
+func TestConfigReferences(t *testing.T) {
+	remo := &natureremo.Device{
+		DeviceCore:   natureremo.DeviceCore{ID: "remo", Name: "Living"},
+		NewestEvents: map[natureremo.SensorType]natureremo.SensorValue{natureremo.SensorTypeTemperature: {Value: 24}},
+	}
+	mini := &natureremo.Device{DeviceCore: natureremo.DeviceCore{ID: "mini", Name: "Bedroom"}}
+	inv := Inventory{
+		Devices: []*natureremo.Device{remo, mini},
+		Appliances: []*natureremo.Appliance{
+			{ID: "aircon", Nickname: "Aircon", Type: natureremo.ApplianceTypeAirCon, Device: &remo.DeviceCore},
+			{ID: "light", Nickname: "Light", Type: natureremo.ApplianceTypeIR, Device: &remo.DeviceCore,
+				Signals: []*natureremo.Signal{{ID: "power", Name: "Power"}}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string
+	}{
+		{name: "nothing"},
+		{name: "known references", change: func(c *Config) {
+			c.Include = []FilterRule{{ID: "aircon"}, {ID: "remo"}}
+			c.Appliances = map[string]ApplianceOverride{
+				"light":  {Type: accessoryTypeSwitch, Signals: map[string]string{"on": "Power"}},
+				"aircon": {TemperatureSensors: []string{"Living"}},
+			}
+			c.Sensors = map[string]SensorOverride{"bedroom": {}}
+		}},
+		{name: "unknown filter id", change: func(c *Config) {
+			c.Exclude = []FilterRule{{ID: "aircon"}, {ID: "tv"}}
+		}, want: []string{"exclude[1].id(tv) was not found"}},
+		{name: "unknown appliance", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"tv": {Name: "TV"}}
+		}, want: []string{"appliances.tv: appliance was not found"}},
+		{name: "signal not learned", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"light": {Type: accessoryTypeSwitch, Signals: map[string]string{"on": "Dim"}}}
+		}, want: []string{`appliances.light: Light: unsupported nature device or appliance: signal "Dim" for on is not learned`}},
+		{name: "temperature sensors of non aircon", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"light": {TemperatureSensors: []string{"Living"}}}
+		}, want: []string{"appliances.light.temperature_sensors: Light is not an air conditioner"}},
+		{name: "temperature sensor without thermometer", change: func(c *Config) {
+			c.Appliances = map[string]ApplianceOverride{"aircon": {TemperatureSensors: []string{"Bedroom"}}}
+		}, want: []string{"appliances.aircon.temperature_sensors: Aircon: unsupported nature device or appliance: Bedroom doesn't have temperature sensor"}},
+		{name: "unknown sensor", change: func(c *Config) {
+			c.Sensors = map[string]SensorOverride{"kitchen": {}}
+		}, want: []string{"sensors.kitchen: device was not found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			if tt.change != nil {
+				tt.change(&c)
+			}
+			got := configReferences(c, inv)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("problems = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Config に設定を足した時に、JSON Schema に漏れがないことを確かめる
+func TestConfigSchemaCoversConfig(t *testing.T) {
+	var walk func(path string, typ reflect.Type, s map[string]interface{})
+	walk = func(path string, typ reflect.Type, s map[string]interface{}) {
+		if typ == reflect.TypeOf(time.Duration(0)) {
+			return
+		}
+		switch typ.Kind() {
+		case reflect.Slice:
+			walk(path+"[]", typ.Elem(), s["items"].(map[string]interface{}))
+		case reflect.Map:
+			walk(path+".*", typ.Elem(), s["additionalProperties"].(map[string]interface{}))
+		case reflect.Struct:
+			props := s["properties"].(map[string]interface{})
+			if len(props) != typ.NumField() {
+				t.Errorf("%s has %d properties, want %d", path, len(props), typ.NumField())
+			}
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				key, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+				if key == "" {
+					key = strings.ToLower(f.Name)
+				}
+				p, found := props[key].(map[string]interface{})
+				if !found {
+					t.Errorf("%s.%s(%s) is not in schema", path, key, f.Name)
+					continue
+				}
+				if d, found := f.Tag.Lookup("default"); found && p["default"] == nil {
+					t.Errorf("%s.%s has no default(%s)", path, key, d)
+				}
+				walk(path+"."+key, f.Type, p)
+			}
+		}
+	}
+	walk("config", reflect.TypeOf(Config{}), configSchema())
+
+	// enum を指定した設定が残っていること
+	types := map[string]reflect.Type{}
+	for _, typ := range []reflect.Type{reflect.TypeOf(FilterRule{}), reflect.TypeOf(ApplianceOverride{}), reflect.TypeOf(SensorOverride{})} {
+		types[typ.Name()] = typ
+	}
+	for key := range schemaEnums {
+		name, field, _ := strings.Cut(key, ".")
+		typ, found := types[name]
+		if !found {
+			t.Errorf("schemaEnums.%s: type %s is unknown", key, name)
+			continue
+		}
+		if _, found := typ.FieldByName(field); !found {
+			t.Errorf("schemaEnums.%s: field %s is unknown", key, field)
+		}
+	}
+}
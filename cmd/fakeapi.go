@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/legnoh/hap-nature-remo/natureremotest"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fakeAPIAddr     string
+	fakeAPIFixtures string
+)
+
+var fakeAPICmd = &cobra.Command{
+	Use:   "fake-api",
+	Short: "start fake Nature Remo Cloud API server for local testing",
+	Long: `Start fake Nature Remo Cloud API server seeded from YAML fixtures.
+Set api_base_url in config.yml to http://<addr>/1 to run serve against it.`,
+	Run: startFakeAPI,
+}
+
+func init() {
+	rootCmd.AddCommand(fakeAPICmd)
+
+	fakeAPICmd.Flags().StringVar(&fakeAPIAddr, "addr", "127.0.0.1:8080", "listen address")
+	fakeAPICmd.Flags().StringVar(&fakeAPIFixtures, "fixtures", "", "fixtures file path")
+	fakeAPICmd.MarkFlagRequired("fixtures")
+}
+
+func startFakeAPI(cmd *cobra.Command, args []string) {
+	fixtures, err := natureremotest.LoadFixtures(fakeAPIFixtures)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures: %s", err)
+	}
+	h := natureremotest.NewHandler(fixtures)
+
+	// 受け取った操作をログに出す
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		if r.Method == http.MethodPost {
+			log.Infof("Command received: %s %s %s", r.Method, r.URL.Path, r.PostForm.Encode())
+		} else {
+			log.Debugf("Request received: %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	log.Infof("Fake Nature API listening: http://%s/1", fakeAPIAddr)
+	if err := http.ListenAndServe(fakeAPIAddr, handler); err != nil {
+		log.Fatal(err)
+	}
+}
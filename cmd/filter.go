@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// アクセサリーの種類(フィルタの type に指定する値)
+const (
+	accessoryTypeSensor         = "sensor"
+	accessoryTypeFan            = "fan"
+	accessoryTypeAirConditioner = "aircon"
+	accessoryTypeWindowCovering = "window_covering"
+	accessoryTypeSwitch         = "switch"
+)
+
+// 公開するデバイス・家電を選ぶ条件
+// 指定した項目が全て一致した場合に条件に合うものとして扱う
+// (name/room は glob か、 /.../ で囲んだ正規表現)
+type FilterRule struct {
+	// デバイス ID または家電 ID
+	ID string
+	// デバイス名または家電のニックネーム
+	Name string
+	// アクセサリーの種類(sensor/fan/aircon/window_covering/switch)
+	Type string
+	// 家電を登録している Remo の名前または ID (センサーの場合は Remo 自身)
+	Room string
+}
+
+// フィルタの対象になるデバイス・家電の情報
+type filterTarget struct {
+	ID       string
+	Name     string
+	Type     string
+	RoomID   string
+	RoomName string
+}
+
+func sensorTarget(device *natureremo.Device) filterTarget {
+	return filterTarget{
+		ID:       device.ID,
+		Name:     device.Name,
+		Type:     accessoryTypeSensor,
+		RoomID:   device.ID,
+		RoomName: device.Name,
+	}
+}
+
+func applianceTarget(appliance *natureremo.Appliance, typ string) filterTarget {
+	t := filterTarget{
+		ID:   appliance.ID,
+		Name: appliance.Nickname,
+		Type: typ,
+	}
+	if appliance.Device != nil {
+		t.RoomID = appliance.Device.ID
+		t.RoomName = appliance.Device.Name
+	}
+	return t
+}
+
+// 文字列を glob か正規表現で比べるもの
+type pattern func(string) bool
+
+func compilePattern(s string) (pattern, error) {
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, err
+	}
+	return func(v string) bool {
+		ok, _ := path.Match(s, v)
+		return ok
+	}, nil
+}
+
+type compiledRule struct {
+	id   string
+	name pattern
+	typ  string
+	room pattern
+}
+
+func (r compiledRule) match(t filterTarget) bool {
+	if r.id != "" && r.id != t.ID {
+		return false
+	}
+	if r.name != nil && !r.name(t.Name) {
+		return false
+	}
+	if r.typ != "" && r.typ != t.Type {
+		return false
+	}
+	if r.room != nil && !r.room(t.RoomName) && !r.room(t.RoomID) {
+		return false
+	}
+	return true
+}
+
+// include/exclude の条件から、公開するデバイス・家電を選ぶもの
+// (include が空の場合は全てを対象にし、 exclude に合うものは include に合っても除く)
+type accessoryFilter struct {
+	include []compiledRule
+	exclude []compiledRule
+}
+
+func newAccessoryFilter(include, exclude []FilterRule) (accessoryFilter, error) {
+	var f accessoryFilter
+	var err error
+	if f.include, err = compileRules("include", include); err != nil {
+		return accessoryFilter{}, err
+	}
+	if f.exclude, err = compileRules("exclude", exclude); err != nil {
+		return accessoryFilter{}, err
+	}
+	return f, nil
+}
+
+func compileRules(key string, rules []FilterRule) ([]compiledRule, error) {
+	var compiled []compiledRule
+	for i, rule := range rules {
+		if rule == (FilterRule{}) {
+			return nil, fmt.Errorf("%s[%d] has no condition", key, i)
+		}
+		switch rule.Type {
+		case "", accessoryTypeSensor, accessoryTypeFan, accessoryTypeAirConditioner, accessoryTypeWindowCovering, accessoryTypeSwitch:
+		default:
+			return nil, fmt.Errorf("%s[%d].type(%s) is unknown. Please use one of %s, %s, %s, %s, %s", key, i, rule.Type, accessoryTypeSensor, accessoryTypeFan, accessoryTypeAirConditioner, accessoryTypeWindowCovering, accessoryTypeSwitch)
+		}
+		c := compiledRule{id: rule.ID, typ: rule.Type}
+		var err error
+		if rule.Name != "" {
+			if c.name, err = compilePattern(rule.Name); err != nil {
+				return nil, fmt.Errorf("%s[%d].name(%s) is invalid: %w", key, i, rule.Name, err)
+			}
+		}
+		if rule.Room != "" {
+			if c.room, err = compilePattern(rule.Room); err != nil {
+				return nil, fmt.Errorf("%s[%d].room(%s) is invalid: %w", key, i, rule.Room, err)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// アクセサリーとして公開するかどうか
+func (f accessoryFilter) allow(t filterTarget) bool {
+	for _, r := range f.exclude {
+		if r.match(t) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, r := range f.include {
+		if r.match(t) {
+			return true
+		}
+	}
+	return false
+}
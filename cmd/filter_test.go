@@ -0,0 +1,94 @@
+package cmd
+
+import "testing"
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{pattern: "Living", value: "Living", want: true},
+		{pattern: "Living", value: "Living Room"},
+		{pattern: "Living*", value: "Living Room", want: true},
+		{pattern: "?edroom", value: "Bedroom", want: true},
+		{pattern: "[", wantErr: true},
+		{pattern: "/^Bed/", value: "Bedroom", want: true},
+		{pattern: "/^Bed/", value: "Kids Bedroom"},
+		{pattern: "/(?i)light/", value: "Ceiling LIGHT", want: true},
+		{pattern: "/(/", wantErr: true},
+		// スラッシュ1文字は正規表現ではなく glob として扱う
+		{pattern: "/", value: "/", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.value, func(t *testing.T) {
+			match, err := compilePattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := match(tt.value); got != tt.want {
+				t.Errorf("match(%q) = %t, want %t", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessoryFilterAllow(t *testing.T) {
+	fan := filterTarget{ID: "fan", Name: "Ceiling Fan", Type: accessoryTypeFan, RoomID: "remo", RoomName: "Living"}
+	sensor := filterTarget{ID: "remo-mini", Name: "Bedroom", Type: accessoryTypeSensor, RoomID: "remo-mini", RoomName: "Bedroom"}
+
+	tests := []struct {
+		name    string
+		include []FilterRule
+		exclude []FilterRule
+		target  filterTarget
+		want    bool
+	}{
+		{name: "no rules", target: fan, want: true},
+		{name: "include by id", include: []FilterRule{{ID: "fan"}}, target: fan, want: true},
+		{name: "not included", include: []FilterRule{{ID: "fan"}}, target: sensor},
+		{name: "include by glob name", include: []FilterRule{{Name: "*Fan"}}, target: fan, want: true},
+		{name: "include by regexp room", include: []FilterRule{{Room: "/^Liv/"}}, target: fan, want: true},
+		{name: "include by room id", include: []FilterRule{{Room: "remo"}}, target: fan, want: true},
+		{name: "all conditions must match", include: []FilterRule{{Name: "*Fan", Type: accessoryTypeSwitch}}, target: fan},
+		{name: "any include rule", include: []FilterRule{{Type: accessoryTypeSwitch}, {Type: accessoryTypeSensor}}, target: sensor, want: true},
+		{name: "exclude by type", exclude: []FilterRule{{Type: accessoryTypeSensor}}, target: sensor},
+		{name: "exclude other", exclude: []FilterRule{{Type: accessoryTypeSensor}}, target: fan, want: true},
+		{name: "exclude over include", include: []FilterRule{{Room: "Living"}}, exclude: []FilterRule{{Name: "/Fan$/"}}, target: fan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newAccessoryFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.allow(tt.target); got != tt.want {
+				t.Errorf("allow = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAccessoryFilterInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []FilterRule
+		exclude []FilterRule
+	}{
+		{name: "empty rule", include: []FilterRule{{}}},
+		{name: "unknown type", exclude: []FilterRule{{Type: "light"}}},
+		{name: "invalid name", include: []FilterRule{{Name: "/(/"}}},
+		{name: "invalid room", exclude: []FilterRule{{Room: "["}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newAccessoryFilter(tt.include, tt.exclude); err == nil {
+				t.Error("err = nil, want error")
+			}
+		})
+	}
+}
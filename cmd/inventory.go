@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+// アクセサリーを組み立てる元になる Nature のデバイス・家電一覧
+// (最後のキャラクタリスティックの値と共に fsStore に保存し、次回起動時はこれからアクセサリーを作る)
+type Inventory struct {
+	Devices    []*natureremo.Device    `json:"devices"`
+	Appliances []*natureremo.Appliance `json:"appliances"`
+	// 家電 ID ごとの信号一覧(ファンとして登録するもののみ)
+	Signals map[string][]*natureremo.Signal `json:"signals,omitempty"`
+	// Nature の ID ごとの、最後のキャラクタリスティックの値
+	Values map[string]map[string]interface{} `json:"values,omitempty"`
+	// 一覧を取得した時刻(保存した一覧では、内容が最後に変わった時の取得時刻)
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 前回の一覧を保存する fsStore のキー
+const inventoryKey = "nature-inventory"
+
+// 一覧の取得に失敗した場合のリトライ間隔の上限
+const inventoryMaxRetryDelay = 30 * time.Second
+
+// Nature API からデバイス・家電・信号の一覧を取得する関数
+// (どれかが取れなかった場合は、一部のアクセサリーだけを公開しないようにエラーにする)
+func fetchInventory(ctx context.Context, nr util.NatureClient) (Inventory, error) {
+	devices := util.GetDevices(ctx, nr)
+	if devices.Err != nil {
+		return Inventory{}, devices.Err
+	}
+	appliances := util.GetAppliances(ctx, nr)
+	if appliances.Err != nil {
+		return Inventory{}, appliances.Err
+	}
+	signals := map[string][]*natureremo.Signal{}
+	for _, appliance := range appliances.Appliances {
+		if !isFan(appliance) {
+			continue
+		}
+		s, err := util.GetSignals(ctx, nr, appliance)
+		if err != nil {
+			return Inventory{}, err
+		}
+		signals[appliance.ID] = s
+	}
+	return Inventory{
+		Devices:    devices.Devices,
+		Appliances: appliances.Appliances,
+		Signals:    signals,
+		UpdatedAt:  time.Now(),
+	}, nil
+}
+
+// デバイス・家電一覧を取得できるまでリトライする関数
+// 一時的な障害でアクセサリーが空のブリッジを公開すると、Home アプリ上の部屋などの設定が消えてしまうため、
+// 取得できるまでリトライし、 retryTimeout を過ぎたら保存しておいた一覧 saved を使う(saved が nil の場合はリトライを続ける)
+// (saved を使った場合は restored を true にして返す。 ctx がキャンセルされた場合はエラーを返す)
+func loadInventory(ctx context.Context, nr util.NatureClient, saved *Inventory, retryTimeout time.Duration) (inv Inventory, restored bool, err error) {
+	deadline := time.Now().Add(retryTimeout)
+	delay := time.Second
+	fallbackChecked := false
+
+	for attempt := 1; ; attempt++ {
+		if !fallbackChecked && !time.Now().Before(deadline) {
+			fallbackChecked = true
+			if saved != nil {
+				log.Warnf("Using saved Nature inventory(%s). Accessories will be updated when Nature API recovers", saved.UpdatedAt.Format(time.DateTime))
+				util.SeedCache(saved.Devices, saved.Appliances, saved.UpdatedAt)
+				return *saved, true, nil
+			}
+			if attempt > 1 {
+				log.Errorf("Saved Nature inventory was not found. Waiting for Nature API to recover...")
+			}
+		}
+
+		inv, err := fetchInventory(ctx, nr)
+		if err == nil {
+			return inv, false, nil
+		}
+		log.Warnf("Failed to get Nature inventory(attempt %d): %s", attempt, err)
+
+		// 保存した一覧に切り替える時刻を過ぎて待たないようにする
+		wait := delay
+		if !fallbackChecked {
+			wait = min(wait, max(time.Until(deadline), 0))
+		}
+		select {
+		case <-ctx.Done():
+			return Inventory{}, false, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, inventoryMaxRetryDelay)
+	}
+}
+
+// 保存しておいた一覧を読み込む関数
+func restoreInventory(store hap.Store) (Inventory, bool) {
+	b, err := store.Get(inventoryKey)
+	if err != nil {
+		return Inventory{}, false
+	}
+	var inv Inventory
+	if err := json.Unmarshal(b, &inv); err != nil {
+		log.Warnf("Saved Nature inventory is broken: %s", err)
+		return Inventory{}, false
+	}
+	return inv, true
+}
+
+// 一覧とアクセサリーの値を fsStore に保存するもの
+type snapshot struct {
+	mu          sync.Mutex
+	store       hap.Store
+	inv         Inventory
+	accessories []natureAccessory
+	// 最後に保存した一覧と値(取得時刻を除く)。変わっていなければ保存し直さない
+	saved []byte
+}
+
+func newSnapshot(store hap.Store, inv Inventory, accessories []natureAccessory) *snapshot {
+	return &snapshot{
+		store:       store,
+		inv:         inv,
+		accessories: accessories,
+	}
+}
+
+// 一覧の取得に成功した時に、最新の一覧で保存し直す
+func (s *snapshot) refresh(devices []*natureremo.Device, appliances []*natureremo.Appliance) {
+	s.mu.Lock()
+	s.inv.Devices = devices
+	s.inv.Appliances = appliances
+	s.inv.UpdatedAt = time.Now()
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		log.Warnf("Failed to save Nature inventory: %s", err)
+	}
+}
+
+// 信号一覧も含めて、取得し直した一覧で保存し直す
+func (s *snapshot) replace(inv Inventory) {
+	s.mu.Lock()
+	s.inv.Devices = inv.Devices
+	s.inv.Appliances = inv.Appliances
+	s.inv.Signals = inv.Signals
+	s.inv.UpdatedAt = inv.UpdatedAt
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		log.Warnf("Failed to save Nature inventory: %s", err)
+	}
+}
+
+// アクセサリーを作り直した時に、新しい一覧とアクセサリーで保存し直す
+func (s *snapshot) reset(inv Inventory, accessories []natureAccessory) {
+	s.mu.Lock()
+	s.inv = inv
+	s.accessories = accessories
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		log.Warnf("Failed to save Nature inventory: %s", err)
+	}
+}
+
+// アクセサリーの現在値(作り直す際に引き継ぐ)
+func (s *snapshot) values() map[string]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := map[string]map[string]interface{}{}
+	for _, na := range s.accessories {
+		values[na.ID] = characteristicValues(na)
+	}
+	return values
+}
+
+// 一覧かアクセサリーの値が前回保存した時から変わっていれば保存する
+// (キャッシュを取得し直すたびに呼ばれるため、取得時刻が変わっただけでは書き込まない)
+func (s *snapshot) save() error {
+	values := s.values()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inv := s.inv
+	inv.Values = values
+	inv.UpdatedAt = time.Time{}
+	content, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, s.saved) {
+		return nil
+	}
+	inv.UpdatedAt = s.inv.UpdatedAt
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Set(inventoryKey, b); err != nil {
+		return err
+	}
+	s.saved = content
+	return nil
+}
+
+// 保存・復元の対象外にするキャラクタリスティック
+func skipValue(s *service.S, c *characteristic.C) bool {
+	if s.Type == service.TypeAccessoryInformation {
+		return true
+	}
+	switch c.Type {
+	case characteristic.TypeName, characteristic.TypeStatusFault, characteristic.TypeStatusActive:
+		return true
+	// 人感センサーの状態は検知時刻から決まるため、前回の値を引き継がない
+	case characteristic.TypeMotionDetected, characteristic.TypeOccupancyDetected:
+		return true
+	}
+	return !c.IsReadable()
+}
+
+func valueKey(s *service.S, c *characteristic.C) string {
+	return s.Type + "/" + c.Type
+}
+
+// アクセサリーのキャラクタリスティックの現在値を集める
+func characteristicValues(na natureAccessory) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, s := range na.Ss {
+		for _, c := range s.Cs {
+			if !skipValue(s, c) {
+				values[valueKey(s, c)] = c.Value()
+			}
+		}
+	}
+	return values
+}
+
+// 保存しておいた値をアクセサリーのキャラクタリスティックに戻す
+// (Home アプリからの操作ではないため、家電には送信されない)
+func restoreValues(accessories []natureAccessory, values map[string]map[string]interface{}) {
+	for _, na := range accessories {
+		saved, found := values[na.ID]
+		if !found {
+			continue
+		}
+		for _, s := range na.Ss {
+			for _, c := range s.Cs {
+				if v, found := saved[valueKey(s, c)]; found && v != nil && !skipValue(s, c) {
+					c.SetValueRequest(v, nil)
+				}
+			}
+		}
+	}
+}
+
+// クラウドが状態を持つデバイス(センサー)・家電(エアコン)の値を除いた、保存しておいた値
+// (クラウドから取得した一覧でアクセサリーを作る場合は、古い値で一覧の状態を上書きしないよう、
+// クラウドに状態がない赤外線リモコンの家電の値だけを引き継ぐ)
+func withoutCloudState(inv Inventory, values map[string]map[string]interface{}) map[string]map[string]interface{} {
+	kept := map[string]map[string]interface{}{}
+	for _, appliance := range inv.Appliances {
+		if v, found := values[appliance.ID]; found && appliance.AirConSettings == nil {
+			kept[appliance.ID] = v
+		}
+	}
+	return kept
+}
+
+// 一覧の変更のうち、アクセサリーの作り直しが必要なもの(名前(ID)の一覧)
+type inventoryDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+func (d inventoryDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// 2つの一覧を比べ、アクセサリーとして登録するデバイス・家電の追加・削除・変更を返す関数
+// (センサーの値やエアコンの設定など、状態の変化は含めない)
+func diffInventory(old, new Inventory, overrides applianceOverrides) inventoryDiff {
+	var diff inventoryDiff
+	oldSources := accessorySources(old, overrides)
+	newSources := accessorySources(new, overrides)
+	for id, src := range newSources {
+		prev, found := oldSources[id]
+		if !found {
+			diff.Added = append(diff.Added, src.name)
+		} else if prev.fingerprint != src.fingerprint {
+			diff.Changed = append(diff.Changed, src.name)
+		}
+	}
+	for id, src := range oldSources {
+		if _, found := newSources[id]; !found {
+			diff.Removed = append(diff.Removed, src.name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+type accessorySource struct {
+	name        string
+	fingerprint string
+}
+
+// アクセサリーの元になるデバイス・家電ごとに、アクセサリーの構成に関わる情報をまとめる
+func accessorySources(inv Inventory, overrides applianceOverrides) map[string]accessorySource {
+	sources := map[string]accessorySource{}
+	deviceID := func(appliance *natureremo.Appliance) string {
+		if appliance.Device == nil {
+			return ""
+		}
+		return appliance.Device.ID
+	}
+	add := func(id, name string, v interface{}) {
+		b, _ := json.Marshal(v)
+		sources[id] = accessorySource{name: name + "(" + id + ")", fingerprint: string(b)}
+	}
+
+	for _, device := range inv.Devices {
+		if !isSensor(device) {
+			continue
+		}
+		var sensors []string
+		for st := range device.NewestEvents {
+			sensors = append(sensors, string(st))
+		}
+		sort.Strings(sensors)
+		add(device.ID, device.Name, []interface{}{device.Name, device.FirmwareVersion, device.SerialNumber, sensors})
+	}
+
+	for _, appliance := range inv.Appliances {
+		switch applianceKind(appliance, overrides) {
+		case accessoryTypeFan, accessoryTypeWindowCovering, accessoryTypeSwitch:
+			var signals []string
+			for _, signal := range applianceSignals(inv, appliance) {
+				signals = append(signals, signal.ID+"/"+signal.Name+"/"+signal.Image)
+			}
+			add(appliance.ID, appliance.Nickname, []interface{}{appliance.Nickname, deviceID(appliance), signals})
+		case accessoryTypeAirConditioner:
+			add(appliance.ID, appliance.Nickname, []interface{}{appliance.Nickname, appliance.Model, deviceID(appliance), appliance.AirCon})
+		}
+	}
+	return sources
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestLoadInventory(t *testing.T) {
+	live := []*natureremo.Device{{DeviceCore: natureremo.DeviceCore{ID: "live"}}}
+	saved := &Inventory{
+		Devices:   []*natureremo.Device{{DeviceCore: natureremo.DeviceCore{ID: "saved"}}},
+		UpdatedAt: time.Now().Add(-time.Hour),
+	}
+	down := &natureremo.APIError{HTTPStatus: http.StatusUnauthorized, Message: "Unauthorized"}
+
+	tests := []struct {
+		name         string
+		err          error
+		saved        *Inventory
+		retryTimeout time.Duration
+		want         string
+		restored     bool
+		wantErr      error
+		minElapsed   time.Duration
+	}{
+		{name: "cloud is up", saved: saved, retryTimeout: time.Minute, want: "live"},
+		{name: "saved without waiting", err: down, saved: saved, want: "saved", restored: true},
+		{name: "saved after timeout", err: down, saved: saved, retryTimeout: 1500 * time.Millisecond, want: "saved", restored: true, minElapsed: 1500 * time.Millisecond},
+		{name: "nothing saved", err: down, retryTimeout: 0, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			util.ResetCache()
+			t.Cleanup(util.ResetCache)
+			nr := naturefake.NewClient(live, nil)
+			nr.SetErr(tt.err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			start := time.Now()
+			inv, restored, err := loadInventory(ctx, nr, tt.saved, tt.retryTimeout)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if restored != tt.restored || len(inv.Devices) != 1 || inv.Devices[0].ID != tt.want {
+				t.Errorf("inventory = %+v(restored %t), want %s(restored %t)", inv.Devices, restored, tt.want, tt.restored)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("elapsed = %s, want at least %s", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+// 最新の一覧でアクセサリーを作る場合は、クラウドが状態を持つエアコンの値を引き継がない
+func TestWithoutCloudState(t *testing.T) {
+	inv := Inventory{
+		Appliances: []*natureremo.Appliance{
+			{ID: "aircon", Type: natureremo.ApplianceTypeAirCon, AirConSettings: &natureremo.AirConSettings{}},
+			{ID: "light", Type: natureremo.ApplianceTypeIR},
+		},
+	}
+	values := map[string]map[string]interface{}{
+		"remo":   {"CurrentTemperature": 24.0},
+		"aircon": {"Active": 1.0},
+		"light":  {"On": true},
+		"gone":   {"On": true},
+	}
+
+	got := withoutCloudState(inv, values)
+	if len(got) != 1 || got["light"]["On"] != true {
+		t.Errorf("values = %v, want only light", got)
+	}
+}
+
+// 書き込んだ回数を数える fsStore
+type countingStore struct {
+	hap.Store
+	sets int
+}
+
+func (s *countingStore) Set(key string, value []byte) error {
+	s.sets++
+	return s.Store.Set(key, value)
+}
+
+// キャッシュを取得し直しても、一覧が変わっていなければ保存し直さない
+func TestSnapshotSavesOnlyChanges(t *testing.T) {
+	store := &countingStore{Store: hap.NewMemStore()}
+	devices := []*natureremo.Device{{DeviceCore: natureremo.DeviceCore{ID: "remo", Name: "Living"}}}
+	snap := newSnapshot(store, Inventory{Devices: devices, UpdatedAt: time.Now()}, nil)
+	if err := snap.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	snap.refresh(devices, nil)
+	if store.sets != 1 {
+		t.Errorf("sets = %d after refresh without changes, want 1", store.sets)
+	}
+
+	renamed := []*natureremo.Device{{DeviceCore: natureremo.DeviceCore{ID: "remo", Name: "Bedroom"}}}
+	snap.refresh(renamed, nil)
+	if store.sets != 2 {
+		t.Errorf("sets = %d after refresh with changes, want 2", store.sets)
+	}
+	saved, found := restoreInventory(store)
+	if !found || len(saved.Devices) != 1 || saved.Devices[0].Name != "Bedroom" || saved.UpdatedAt.IsZero() {
+		t.Errorf("saved = %+v, want Bedroom with updated time", saved)
+	}
+}
+
+// アクセサリーの構成が変わるものだけを差分として返し、状態の変化は無視する
+func TestDiffInventory(t *testing.T) {
+	newInventory := func() Inventory {
+		remo := &natureremo.Device{
+			DeviceCore:   natureremo.DeviceCore{ID: "remo", Name: "Living", FirmwareVersion: "Remo/1.0.0"},
+			NewestEvents: map[natureremo.SensorType]natureremo.SensorValue{natureremo.SensorTypeTemperature: {Value: 24}},
+		}
+		return Inventory{
+			Devices: []*natureremo.Device{remo},
+			Appliances: []*natureremo.Appliance{
+				{ID: "aircon", Nickname: "Aircon", Type: natureremo.ApplianceTypeAirCon, Device: &remo.DeviceCore,
+					AirConSettings: &natureremo.AirConSettings{Temperature: "24"}},
+				{ID: "light", Nickname: "Light", Type: natureremo.ApplianceTypeIR, Device: &remo.DeviceCore,
+					Signals: []*natureremo.Signal{{ID: "power", Name: "Power"}}},
+				{ID: "fan", Nickname: "Fan", Type: natureremo.ApplianceTypeIR, Image: "ico_fan", Device: &remo.DeviceCore},
+			},
+		}
+	}
+	switchLight := applianceOverrides{"light": {Type: accessoryTypeSwitch}}
+
+	tests := []struct {
+		name      string
+		change    func(inv *Inventory)
+		overrides applianceOverrides
+		want      inventoryDiff
+	}{
+		{name: "nothing", change: func(inv *Inventory) {}},
+		{name: "state only", change: func(inv *Inventory) {
+			inv.Devices[0].NewestEvents[natureremo.SensorTypeTemperature] = natureremo.SensorValue{Value: 26}
+			inv.Appliances[0].AirConSettings.Temperature = "27"
+		}},
+		{name: "sensor added to device", change: func(inv *Inventory) {
+			inv.Devices[0].NewestEvents[natureremo.SensorTypeHumidity] = natureremo.SensorValue{Value: 50}
+		}, want: inventoryDiff{Changed: []string{"Living(remo)"}}},
+		{name: "firmware updated", change: func(inv *Inventory) {
+			inv.Devices[0].FirmwareVersion = "Remo/1.1.0"
+		}, want: inventoryDiff{Changed: []string{"Living(remo)"}}},
+		{name: "appliance renamed", change: func(inv *Inventory) {
+			inv.Appliances[2].Nickname = "Ceiling Fan"
+		}, want: inventoryDiff{Changed: []string{"Ceiling Fan(fan)"}}},
+		{name: "appliance added and removed", change: func(inv *Inventory) {
+			inv.Appliances[2] = &natureremo.Appliance{ID: "fan2", Nickname: "Fan 2", Type: natureremo.ApplianceTypeIR, Image: "ico_fan"}
+		}, want: inventoryDiff{Added: []string{"Fan 2(fan2)"}, Removed: []string{"Fan(fan)"}}},
+		// 上書き設定がない家電はアクセサリーにならないため、信号が増えても変わらない
+		{name: "signal of unregistered appliance", change: func(inv *Inventory) {
+			inv.Appliances[1].Signals = append(inv.Appliances[1].Signals, &natureremo.Signal{ID: "dim", Name: "Dim"})
+		}},
+		{name: "signal of overridden appliance", overrides: switchLight, change: func(inv *Inventory) {
+			inv.Appliances[1].Signals = append(inv.Appliances[1].Signals, &natureremo.Signal{ID: "dim", Name: "Dim"})
+		}, want: inventoryDiff{Changed: []string{"Light(light)"}}},
+		{name: "appliance removed from overridden inventory", overrides: switchLight, change: func(inv *Inventory) {
+			inv.Appliances = inv.Appliances[:1]
+		}, want: inventoryDiff{Removed: []string{"Fan(fan)", "Light(light)"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, inv := newInventory(), newInventory()
+			tt.change(&inv)
+			got := diffInventory(old, inv, tt.overrides)
+			if !slices.Equal(got.Added, tt.want.Added) || !slices.Equal(got.Removed, tt.want.Removed) || !slices.Equal(got.Changed, tt.want.Changed) {
+				t.Errorf("diff = %+v, want %+v", got, tt.want)
+			}
+			if got.empty() != tt.want.empty() {
+				t.Errorf("empty = %t, want %t", got.empty(), tt.want.empty())
+			}
+		})
+	}
+}
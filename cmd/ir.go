@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tenntenn/natureremo"
+)
+
+var (
+	irCacheDirectory  string
+	irCaptureTimeout  time.Duration
+	irDiscoverTimeout time.Duration
+)
+
+var irCmd = &cobra.Command{
+	Use:   "ir-capture <appliance> <signal>",
+	Short: "capture raw IR data of a learned signal for the local API",
+	Long: `Capture raw IR data of a learned signal from Nature Remo on the local network.
+Point the remote controller at Nature Remo and press the button after the prompt.
+Captured signals are sent over the Remo local API by serve when local_api is enabled.
+<appliance> and <signal> accept either the nickname/name or the ID.`,
+	Args: cobra.ExactArgs(2),
+	Run:  captureIR,
+}
+
+func init() {
+	rootCmd.AddCommand(irCmd)
+
+	home, err := os.UserHomeDir()
+	cobra.CheckErr(err)
+	confDir = home + "/.hap-nature-remo"
+
+	irCmd.Flags().StringVarP(&cfgFile, "config", "c", confDir+"/config.yml", "config file path")
+	irCmd.Flags().StringVar(&irCacheDirectory, "ir-cache", confDir+"/ir", "raw IR data directory path")
+	irCmd.Flags().DurationVar(&irCaptureTimeout, "timeout", 30*time.Second, "time to wait for the button press")
+	irCmd.Flags().DurationVar(&irDiscoverTimeout, "discover-timeout", 30*time.Second, "time to wait for Nature Remo to be found on the local network")
+}
+
+func captureIR(cmd *cobra.Command, args []string) {
+	viper.SetConfigFile(cfgFile)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatal(err)
+	}
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	applyConfig(c)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nr := util.NewClient(c.Token, c.RateLimitReserve)
+	if c.APIBaseURL != "" {
+		nr.BaseURL = c.APIBaseURL
+	}
+	appliance, sig, err := findSignal(ctx, nr, args[0], args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if appliance.Device == nil {
+		log.Fatalf("Nature Remo of %s is unknown", appliance.Nickname)
+	}
+
+	cache, err := util.NewIRCache(irCacheDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	local := util.NewLocalClient(nr, cache, util.LocalModePrefer)
+	go local.Discover(ctx)
+
+	// mDNS で Remo が見つかるまで待つ(discover-timeout を過ぎても見つからない場合は終了する)
+	discoverCtx, cancel := context.WithTimeout(ctx, irDiscoverTimeout)
+	defer cancel()
+	var remo *natureremo.LocalClient
+	for {
+		if remo, err = local.Remo(appliance.Device); err == nil {
+			break
+		}
+		select {
+		case <-discoverCtx.Done():
+			if ctx.Err() != nil {
+				return
+			}
+			log.Fatalf("Nature Remo %s was not found on the local network within %s", appliance.Device.Name, irDiscoverTimeout)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	// 前回受信した信号と違うものが届くまで待つ
+	prev, err := remo.Fetch(ctx)
+	if err != nil {
+		log.Fatalf("Failed to read Nature Remo local API: %s", err)
+	}
+	fmt.Printf("Point the remote at %s and press %q of %s...\n", appliance.Device.Name, sig.Name, appliance.Nickname)
+	deadline := time.After(irCaptureTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Fatalf("No IR signal was received within %s", irCaptureTimeout)
+		case <-time.After(500 * time.Millisecond):
+		}
+		ir, err := remo.Fetch(ctx)
+		if err != nil {
+			log.Warnf("Failed to read Nature Remo local API: %s", err)
+			continue
+		}
+		if len(ir.Data) == 0 || reflect.DeepEqual(ir, prev) {
+			continue
+		}
+		if err := cache.Set(sig.ID, ir); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Captured %s of %s(%d pulses)", sig.Name, appliance.Nickname, len(ir.Data))
+		return
+	}
+}
+
+// ニックネーム・名前または ID で家電と信号を探す
+func findSignal(ctx context.Context, nr util.NatureClient, applianceKey, signalKey string) (*natureremo.Appliance, *natureremo.Signal, error) {
+	appliances := util.GetAppliances(ctx, nr)
+	if appliances.Err != nil {
+		return nil, nil, appliances.Err
+	}
+	for _, appliance := range appliances.Appliances {
+		if appliance.ID != applianceKey && appliance.Nickname != applianceKey {
+			continue
+		}
+		for _, sig := range appliance.Signals {
+			if sig.ID == signalKey || sig.Name == signalKey {
+				return appliance, sig, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("signal %q is not learned in %s", signalKey, appliance.Nickname)
+	}
+	return nil, nil, fmt.Errorf("appliance %q was not found", applianceKey)
+}
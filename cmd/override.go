@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/legnoh/hap-nature-remo/additionalaccessory"
+	"github.com/tenntenn/natureremo"
+)
+
+// 家電ごとに、Home アプリでの見え方や扱い方を変える設定
+// (appliances の下に、家電 ID またはニックネームをキーにして書く)
+type ApplianceOverride struct {
+	// Home アプリでの名前
+	Name string
+	// アクセサリーのカテゴリ(fan/switch/window_covering など)
+	Category string
+	// 付属情報に表示するメーカー・型番・シリアル番号
+	Manufacturer string
+	Model        string
+	SerialNumber string `mapstructure:"serial_number"`
+	// 赤外線リモコンの家電をどのアクセサリーとして扱うか(fan/window_covering/switch)
+	Type string
+	// アクセサリーの操作に使う信号(操作名ごとに信号名または信号 ID)
+	Signals map[string]string
+	// エアコンの室温として使う温度計の Remo (名前またはデバイス ID 。複数の場合は平均)
+	TemperatureSensors []string `mapstructure:"temperature_sensors"`
+}
+
+// 家電 ID・ニックネームごとの上書き設定
+type applianceOverrides map[string]ApplianceOverride
+
+// 家電の上書き設定を探す
+// (viper がキーを小文字にするため、大文字小文字を区別せず、 ID を優先して探す)
+func (o applianceOverrides) lookup(appliance *natureremo.Appliance) (ApplianceOverride, bool) {
+	for _, key := range []string{appliance.ID, appliance.Nickname} {
+		for k, v := range o {
+			if strings.EqualFold(k, key) {
+				return v, true
+			}
+		}
+	}
+	return ApplianceOverride{}, false
+}
+
+// Remo デバイスごとに、センサーの扱い方を変える設定
+// (sensors の下に、デバイス ID または名前をキーにして書く)
+type SensorOverride struct {
+	// 温度・湿度の補正(値 * scale + offset)
+	Temperature additionalaccessory.Calibration
+	Humidity    additionalaccessory.Calibration
+	// 照度センサーの値(0-200)から lux への変換表
+	Illuminance []additionalaccessory.LuxPoint
+	// 人感センサーを公開するサービス(motion/occupancy/both)
+	MotionService string `mapstructure:"motion_service"`
+	// 人感センサー・在室センサーが検知したとみなす、最後の検知からの時間
+	MotionWindow    time.Duration `mapstructure:"motion_window"`
+	OccupancyWindow time.Duration `mapstructure:"occupancy_window"`
+}
+
+// デバイス ID・名前ごとのセンサーの設定
+type sensorOverrides map[string]SensorOverride
+
+// デバイスのセンサーの設定を探す
+// (viper がキーを小文字にするため、大文字小文字を区別せず、 ID を優先して探す)
+func (o sensorOverrides) lookup(device *natureremo.Device) (SensorOverride, bool) {
+	for _, key := range []string{device.ID, device.Name} {
+		for k, v := range o {
+			if strings.EqualFold(k, key) {
+				return v, true
+			}
+		}
+	}
+	return SensorOverride{}, false
+}
+
+func (o SensorOverride) options(cals *additionalaccessory.Calibrations) additionalaccessory.SensorOptions {
+	return additionalaccessory.SensorOptions{
+		Calibrations:    cals,
+		MotionService:   o.MotionService,
+		MotionWindow:    o.MotionWindow,
+		OccupancyWindow: o.OccupancyWindow,
+	}
+}
+
+func (o SensorOverride) calibration() additionalaccessory.SensorCalibration {
+	return additionalaccessory.SensorCalibration{
+		Temperature: o.Temperature,
+		Humidity:    o.Humidity,
+		Illuminance: o.Illuminance,
+	}
+}
+
+// デバイス ID ごとのセンサーの値の補正
+func (o sensorOverrides) calibrations(devices []*natureremo.Device) map[string]additionalaccessory.SensorCalibration {
+	cals := map[string]additionalaccessory.SensorCalibration{}
+	for _, device := range devices {
+		if so, found := o.lookup(device); found {
+			cals[device.ID] = so.calibration()
+		}
+	}
+	return cals
+}
+
+// センサーの設定の書き方が正しいかを確認する関数
+func validateSensorOverrides(overrides map[string]SensorOverride) error {
+	for key, o := range overrides {
+		if err := o.calibration().Validate(); err != nil {
+			return fmt.Errorf("sensors.%s.%w", key, err)
+		}
+		switch o.MotionService {
+		case "", additionalaccessory.MotionServiceMotion, additionalaccessory.MotionServiceOccupancy, additionalaccessory.MotionServiceBoth:
+		default:
+			return fmt.Errorf("sensors.%s.motion_service(%s) is unknown. Please use one of %s, %s, %s", key, o.MotionService, additionalaccessory.MotionServiceMotion, additionalaccessory.MotionServiceOccupancy, additionalaccessory.MotionServiceBoth)
+		}
+		if o.MotionWindow < 0 || o.OccupancyWindow < 0 {
+			return fmt.Errorf("sensors.%s.motion_window/occupancy_window must not be negative", key)
+		}
+	}
+	return nil
+}
+
+// category に指定できる値
+var accessoryCategories = map[string]byte{
+	"other":           accessory.TypeOther,
+	"fan":             accessory.TypeFan,
+	"lightbulb":       accessory.TypeLightbulb,
+	"outlet":          accessory.TypeOutlet,
+	"switch":          accessory.TypeSwitch,
+	"window":          accessory.TypeWindow,
+	"window_covering": accessory.TypeWindowCovering,
+	"air_purifier":    accessory.TypeAirPurifier,
+	"heater":          accessory.TypeHeater,
+	"air_conditioner": accessory.TypeAirConditioner,
+	"humidifier":      accessory.TypeHumidifier,
+	"dehumidifier":    accessory.TypeDehumidifier,
+	"television":      accessory.TypeTelevision,
+}
+
+func categoryNames() []string {
+	var names []string
+	for name := range accessoryCategories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 上書き設定の書き方が正しいかを確認する関数
+func validateOverrides(overrides map[string]ApplianceOverride) error {
+	for key, o := range overrides {
+		if _, found := accessoryCategories[o.Category]; o.Category != "" && !found {
+			return fmt.Errorf("appliances.%s.category(%s) is unknown. Please use one of %v", key, o.Category, categoryNames())
+		}
+		if len(o.TemperatureSensors) != 0 && o.Type != "" {
+			return fmt.Errorf("appliances.%s.temperature_sensors can't be used with type(%s)", key, o.Type)
+		}
+		switch o.Type {
+		case "":
+			if len(o.Signals) != 0 {
+				return fmt.Errorf("appliances.%s.signals requires type", key)
+			}
+		case accessoryTypeFan:
+			for action := range o.Signals {
+				if _, ok := fanSpeed(action); !ok && action != "forward" && action != "backward" {
+					return fmt.Errorf("appliances.%s.signals.%s is unknown. Please use 0-9, forward or backward", key, action)
+				}
+			}
+		case accessoryTypeWindowCovering:
+			if o.Signals["open"] == "" || o.Signals["close"] == "" {
+				return fmt.Errorf("appliances.%s.signals requires open and close", key)
+			}
+		case accessoryTypeSwitch:
+			if o.Signals["off"] != "" && o.Signals["on"] == "" {
+				return fmt.Errorf("appliances.%s.signals.off requires on", key)
+			}
+		default:
+			return fmt.Errorf("appliances.%s.type(%s) is unknown. Please use one of %s, %s, %s", key, o.Type, accessoryTypeFan, accessoryTypeWindowCovering, accessoryTypeSwitch)
+		}
+	}
+	return nil
+}
+
+// ファンの信号の操作名から風量を取り出す
+func fanSpeed(action string) (int, bool) {
+	if len(action) != 1 {
+		return 0, false
+	}
+	level, err := strconv.Atoi(action)
+	return level, err == nil
+}
+
+// 家電をどのアクセサリーとして登録するか(登録しない場合は空)
+// (上書き設定の type があればそれを、なければ家電の種類・アイコンから決める)
+func applianceKind(appliance *natureremo.Appliance, overrides applianceOverrides) string {
+	if o, found := overrides.lookup(appliance); found && o.Type != "" {
+		return o.Type
+	}
+	switch {
+	case isFan(appliance):
+		return accessoryTypeFan
+	case isAirConditioner(appliance):
+		return accessoryTypeAirConditioner
+	}
+	return ""
+}
+
+// 家電の学習済みの信号一覧
+// (ファンとして取得した信号がなければ、家電一覧に含まれる信号を使う)
+func applianceSignals(inv Inventory, appliance *natureremo.Appliance) []*natureremo.Signal {
+	if signals, found := inv.Signals[appliance.ID]; found {
+		return signals
+	}
+	return appliance.Signals
+}
+
+// 操作名ごとに、上書き設定で指定した信号を探す
+func overrideSignals(appliance *natureremo.Appliance, signals []*natureremo.Signal, o ApplianceOverride) (map[string]*natureremo.Signal, error) {
+	found := map[string]*natureremo.Signal{}
+	for action, key := range o.Signals {
+		i := slices.IndexFunc(signals, func(s *natureremo.Signal) bool {
+			return s.ID == key || s.Name == key
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %w: signal %q for %s is not learned", appliance.Nickname, additionalaccessory.ErrUnsupported, key, action)
+		}
+		found[action] = signals[i]
+	}
+	return found, nil
+}
+
+// 上書き設定からファンの信号を選ぶ(信号の指定がなければアイコンから選ぶ)
+func overrideFanSignals(appliance *natureremo.Appliance, signals []*natureremo.Signal, o ApplianceOverride) (additionalaccessory.FanSignals, error) {
+	if len(o.Signals) == 0 {
+		return additionalaccessory.FanSignalsFromIcons(applianceLogger(appliance), signals), nil
+	}
+	actions, err := overrideSignals(appliance, signals, o)
+	if err != nil {
+		return additionalaccessory.FanSignals{}, err
+	}
+	fs := additionalaccessory.FanSignals{
+		Speeds:     map[int]*natureremo.Signal{},
+		Directions: map[string]*natureremo.Signal{},
+	}
+	for action, signal := range actions {
+		if level, ok := fanSpeed(action); ok {
+			fs.Speeds[level] = signal
+		} else {
+			fs.Directions[strings.TrimSuffix(action, "ward")] = signal
+		}
+	}
+	return fs, nil
+}
+
+// 上書き設定からスイッチの信号を選ぶ
+// (on/off 以外の信号はボタンにし、信号の指定がなければ学習済みの全ての信号をボタンにする)
+func overrideSwitchSignals(appliance *natureremo.Appliance, signals []*natureremo.Signal, o ApplianceOverride) (additionalaccessory.SwitchSignals, error) {
+	if len(o.Signals) == 0 {
+		return additionalaccessory.SwitchSignals{Buttons: signals}, nil
+	}
+	actions, err := overrideSignals(appliance, signals, o)
+	if err != nil {
+		return additionalaccessory.SwitchSignals{}, err
+	}
+	ss := additionalaccessory.SwitchSignals{On: actions["on"], Off: actions["off"]}
+	var buttons []string
+	for action := range actions {
+		if action != "on" && action != "off" {
+			buttons = append(buttons, action)
+		}
+	}
+	sort.Strings(buttons)
+	for _, action := range buttons {
+		ss.Buttons = append(ss.Buttons, actions[action])
+	}
+	return ss, nil
+}
+
+// 上書き設定で指定した、室温として使う温度計のデバイス ID を探す
+func overrideTemperatureSensors(appliance *natureremo.Appliance, devices []*natureremo.Device, o ApplianceOverride) ([]string, error) {
+	var ids []string
+	for _, key := range o.TemperatureSensors {
+		i := slices.IndexFunc(devices, func(d *natureremo.Device) bool {
+			return d.ID == key || d.Name == key
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %w: temperature sensor %q was not found", appliance.Nickname, additionalaccessory.ErrUnsupported, key)
+		}
+		if _, found := devices[i].NewestEvents[natureremo.SensorTypeTemperature]; !found {
+			return nil, fmt.Errorf("%s: %w: %s doesn't have temperature sensor", appliance.Nickname, additionalaccessory.ErrUnsupported, devices[i].Name)
+		}
+		ids = append(ids, devices[i].ID)
+	}
+	return ids, nil
+}
+
+// 上書き設定の名前・カテゴリ・付属情報をアクセサリーに反映する
+func applyOverride(a *accessory.A, o ApplianceOverride) {
+	if o.Name != "" {
+		a.Info.Name.SetValue(o.Name)
+	}
+	if o.Manufacturer != "" {
+		a.Info.Manufacturer.SetValue(o.Manufacturer)
+	}
+	if o.Model != "" {
+		a.Info.Model.SetValue(o.Model)
+	}
+	if o.SerialNumber != "" {
+		a.Info.SerialNumber.SetValue(o.SerialNumber)
+	}
+	if category, found := accessoryCategories[o.Category]; found {
+		a.Type = category
+	}
+}
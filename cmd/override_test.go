@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/brutella/hap/accessory"
+	"github.com/legnoh/hap-nature-remo/additionalaccessory"
+	"github.com/tenntenn/natureremo"
+)
+
+func TestApplianceOverridesLookup(t *testing.T) {
+	appliance := &natureremo.Appliance{ID: "light-id", Nickname: "Ceiling Light"}
+	tests := []struct {
+		name      string
+		overrides applianceOverrides
+		want      string
+		found     bool
+	}{
+		{name: "by id", overrides: applianceOverrides{"light-id": {Name: "by id"}}, want: "by id", found: true},
+		{name: "by nickname", overrides: applianceOverrides{"Ceiling Light": {Name: "by nickname"}}, want: "by nickname", found: true},
+		// viper はキーを小文字にする
+		{name: "case insensitive", overrides: applianceOverrides{"ceiling light": {Name: "lower"}}, want: "lower", found: true},
+		{name: "id over nickname", overrides: applianceOverrides{"ceiling light": {Name: "by nickname"}, "LIGHT-ID": {Name: "by id"}}, want: "by id", found: true},
+		{name: "not found", overrides: applianceOverrides{"fan": {Name: "Fan"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, found := tt.overrides.lookup(appliance)
+			if found != tt.found || o.Name != tt.want {
+				t.Errorf("lookup = %q(found %t), want %q(found %t)", o.Name, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestValidateOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		o       ApplianceOverride
+		wantErr bool
+	}{
+		{name: "empty", o: ApplianceOverride{}},
+		{name: "category", o: ApplianceOverride{Category: "lightbulb"}},
+		{name: "unknown category", o: ApplianceOverride{Category: "robot"}, wantErr: true},
+		{name: "signals without type", o: ApplianceOverride{Signals: map[string]string{"on": "Power"}}, wantErr: true},
+		{name: "unknown type", o: ApplianceOverride{Type: "light"}, wantErr: true},
+		{name: "fan speeds and direction", o: ApplianceOverride{Type: accessoryTypeFan, Signals: map[string]string{"0": "Off", "3": "High", "forward": "Swing"}}},
+		{name: "unknown fan action", o: ApplianceOverride{Type: accessoryTypeFan, Signals: map[string]string{"10": "Turbo"}}, wantErr: true},
+		{name: "window covering", o: ApplianceOverride{Type: accessoryTypeWindowCovering, Signals: map[string]string{"open": "Up", "close": "Down"}}},
+		{name: "window covering without close", o: ApplianceOverride{Type: accessoryTypeWindowCovering, Signals: map[string]string{"open": "Up"}}, wantErr: true},
+		{name: "switch", o: ApplianceOverride{Type: accessoryTypeSwitch, Signals: map[string]string{"on": "Power"}}},
+		{name: "switch off without on", o: ApplianceOverride{Type: accessoryTypeSwitch, Signals: map[string]string{"off": "Power"}}, wantErr: true},
+		{name: "temperature sensors", o: ApplianceOverride{TemperatureSensors: []string{"Living"}}},
+		{name: "temperature sensors with type", o: ApplianceOverride{Type: accessoryTypeSwitch, TemperatureSensors: []string{"Living"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateOverrides(map[string]ApplianceOverride{"light": tt.o})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyOverride(t *testing.T) {
+	info := accessory.Info{Name: "Light", Manufacturer: "Nature", Model: "IR", SerialNumber: "1"}
+	tests := []struct {
+		name     string
+		o        ApplianceOverride
+		want     accessory.Info
+		category byte
+	}{
+		{name: "nothing", want: info, category: accessory.TypeSwitch},
+		{name: "all", o: ApplianceOverride{Name: "Lamp", Manufacturer: "Acme", Model: "L-1", SerialNumber: "42", Category: "lightbulb"},
+			want: accessory.Info{Name: "Lamp", Manufacturer: "Acme", Model: "L-1", SerialNumber: "42"}, category: accessory.TypeLightbulb},
+		{name: "name only", o: ApplianceOverride{Name: "Lamp"}, want: accessory.Info{Name: "Lamp", Manufacturer: "Nature", Model: "IR", SerialNumber: "1"}, category: accessory.TypeSwitch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := accessory.New(info, accessory.TypeSwitch)
+			applyOverride(a, tt.o)
+			got := accessory.Info{Name: a.Info.Name.Value(), Manufacturer: a.Info.Manufacturer.Value(), Model: a.Info.Model.Value(), SerialNumber: a.Info.SerialNumber.Value()}
+			if got != tt.want {
+				t.Errorf("info = %+v, want %+v", got, tt.want)
+			}
+			if a.Type != tt.category {
+				t.Errorf("category = %d, want %d", a.Type, tt.category)
+			}
+		})
+	}
+}
+
+func TestApplianceKind(t *testing.T) {
+	tests := []struct {
+		name      string
+		appliance *natureremo.Appliance
+		overrides applianceOverrides
+		want      string
+	}{
+		{name: "fan icon", appliance: &natureremo.Appliance{ID: "fan", Type: natureremo.ApplianceTypeIR, Image: "ico_fan"}, want: accessoryTypeFan},
+		{name: "aircon", appliance: &natureremo.Appliance{ID: "aircon", Type: natureremo.ApplianceTypeAirCon}, want: accessoryTypeAirConditioner},
+		{name: "unknown ir", appliance: &natureremo.Appliance{ID: "light", Type: natureremo.ApplianceTypeIR, Image: "ico_light"}},
+		{name: "type override", appliance: &natureremo.Appliance{ID: "light", Type: natureremo.ApplianceTypeIR, Image: "ico_light"},
+			overrides: applianceOverrides{"light": {Type: accessoryTypeSwitch}}, want: accessoryTypeSwitch},
+		{name: "override without type", appliance: &natureremo.Appliance{ID: "fan", Type: natureremo.ApplianceTypeIR, Image: "ico_fan"},
+			overrides: applianceOverrides{"fan": {Name: "Ceiling Fan"}}, want: accessoryTypeFan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applianceKind(tt.appliance, tt.overrides); got != tt.want {
+				t.Errorf("kind = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverrideSignals(t *testing.T) {
+	appliance := &natureremo.Appliance{ID: "fan", Nickname: "Fan"}
+	off := &natureremo.Signal{ID: "sig-off", Name: "Off"}
+	high := &natureremo.Signal{ID: "sig-high", Name: "High"}
+	swing := &natureremo.Signal{ID: "sig-swing", Name: "Swing"}
+	timer := &natureremo.Signal{ID: "sig-timer", Name: "Timer"}
+	signals := []*natureremo.Signal{off, high, swing, timer}
+
+	t.Run("by name or id", func(t *testing.T) {
+		got, err := overrideSignals(appliance, signals, ApplianceOverride{Signals: map[string]string{"on": "High", "off": "sig-off"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got["on"] != high || got["off"] != off {
+			t.Errorf("signals = %v", got)
+		}
+	})
+
+	t.Run("not learned", func(t *testing.T) {
+		_, err := overrideSignals(appliance, signals, ApplianceOverride{Signals: map[string]string{"on": "Turbo"}})
+		if !errors.Is(err, additionalaccessory.ErrUnsupported) {
+			t.Errorf("err = %v, want %v", err, additionalaccessory.ErrUnsupported)
+		}
+	})
+
+	t.Run("fan", func(t *testing.T) {
+		fs, err := overrideFanSignals(appliance, signals, ApplianceOverride{Type: accessoryTypeFan, Signals: map[string]string{"0": "Off", "3": "High", "forward": "Swing"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fs.Speeds[0] != off || fs.Speeds[3] != high || fs.Directions["for"] != swing || len(fs.Speeds) != 2 || len(fs.Directions) != 1 {
+			t.Errorf("fan signals = %+v", fs)
+		}
+	})
+
+	t.Run("switch", func(t *testing.T) {
+		ss, err := overrideSwitchSignals(appliance, signals, ApplianceOverride{Type: accessoryTypeSwitch, Signals: map[string]string{"on": "High", "timer": "Timer", "swing": "Swing"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// on/off 以外は操作名の順にボタンにする
+		if ss.On != high || ss.Off != nil || len(ss.Buttons) != 2 || ss.Buttons[0] != swing || ss.Buttons[1] != timer {
+			t.Errorf("switch signals = %+v", ss)
+		}
+	})
+
+	t.Run("switch without signals", func(t *testing.T) {
+		ss, err := overrideSwitchSignals(appliance, signals, ApplianceOverride{Type: accessoryTypeSwitch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ss.On != nil || len(ss.Buttons) != len(signals) {
+			t.Errorf("switch signals = %+v, want all learned signals as buttons", ss)
+		}
+	})
+}
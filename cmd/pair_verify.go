@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/brutella/hap"
+	"github.com/go-chi/chi"
+)
+
+// hap の pair-verify は M4 のレスポンスを送り切る前に接続を暗号化に切り替えるため、
+// その間に接続の読み込みが走ると M4 が暗号化されてしまい、コントローラーが読めずにセッションを張れない
+// (接続の暗号化の状態を読み書きする goroutine が競合する)
+// 暗号化に切り替える前に M4 を送り切るよう、pair-verify のハンドラーを包み直す関数
+func flushPairVerify(server *hap.Server) {
+	mux := server.ServeMux().(*chi.Mux)
+	for _, r := range mux.Routes() {
+		h, found := r.Handlers[http.MethodPost]
+		if r.Pattern != "/pair-verify" || !found {
+			continue
+		}
+		mux.Post(r.Pattern, func(w http.ResponseWriter, req *http.Request) {
+			h.ServeHTTP(flushWriter{w}, req)
+		})
+	}
+}
+
+// 書いたレスポンスをすぐに送り切る ResponseWriter
+// (pair-verify のレスポンスは1回で書かれるため、その長さを Content-Length にする)
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushWriter) Write(b []byte) (int, error) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	n, err := w.ResponseWriter.Write(b)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
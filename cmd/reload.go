@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/creasty/defaults"
+	"github.com/fsnotify/fsnotify"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// viper に読み込んだ設定ファイルから Config を作る関数
+func loadConfig() (Config, error) {
+	var c Config
+	if err := viper.Unmarshal(&c); err != nil {
+		return Config{}, err
+	}
+	if err := defaults.Set(&c); err != nil {
+		return Config{}, err
+	}
+	if !regexp.MustCompile(`^[0-9]{8}$`).MatchString(c.Pin) {
+		return Config{}, fmt.Errorf("Your PinCode(%s) is invalid format. Please fix to 8-digit code(e.g. 12344321)", c.Pin)
+	}
+	if _, err := newAccessoryFilter(c.Include, c.Exclude); err != nil {
+		return Config{}, fmt.Errorf("Your include/exclude is invalid: %w", err)
+	}
+	if err := validateOverrides(c.Appliances); err != nil {
+		return Config{}, fmt.Errorf("Your appliances is invalid: %w", err)
+	}
+	if err := validateSensorOverrides(c.Sensors); err != nil {
+		return Config{}, fmt.Errorf("Your sensors is invalid: %w", err)
+	}
+	for component, level := range c.LogLevels {
+		if !slices.Contains(util.LogComponents(), component) {
+			return Config{}, fmt.Errorf("Your log_levels has unknown component(%s). Please use one of %v", component, util.LogComponents())
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return Config{}, fmt.Errorf("Your log_levels.%s is invalid: %s", component, err)
+		}
+	}
+	return c, nil
+}
+
+// HAP サーバーを止めずに反映できる設定を反映する関数
+func applyConfig(c Config) {
+	util.SetCacheTTL(c.CacheTTL)
+	util.SetCommandDebounce(c.CommandDebounce)
+	util.SetAPITimeout(c.APITimeout)
+	util.SetAPIRetries(c.APIRetries)
+	util.SetRateLimitReserve(c.RateLimitReserve)
+	util.SetHealthCheckInterval(c.HealthCheckInterval)
+	util.SetDeviceStaleAfter(c.DeviceStaleAfter)
+
+	// --debug 指定時は、全てのまとまりで debug ログを出したままにする
+	if !debug {
+		for _, component := range util.LogComponents() {
+			level, found := c.LogLevels[component]
+			if !found {
+				level = logrus.InfoLevel.String()
+			}
+			util.SetLogLevel(util.Component(component), level)
+		}
+	}
+
+	// 再生時は記録時点から時間が経っているため、 Remo デバイスの更新途絶を障害として扱わない
+	if replayDir != "" {
+		util.SetDeviceStaleAfter(0)
+	}
+}
+
+// 設定ファイルの変更・SIGHUP で設定を読み込み直す関数
+// (ctx がキャンセルされるまで戻らない)
+// viper.WatchConfig は変更を検知すると別の goroutine で設定ファイルを読み直してしまうため使わず、
+// ファイルの変更も SIGHUP と同じくこの関数の中で1つずつ読み込み直す
+func watchConfig(ctx context.Context, bridge *Bridge, nr *util.CloudClient) {
+	reload := func(reason string) {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Errorf("Failed to reload config(%s): %s", reason, err)
+			return
+		}
+		c, err := loadConfig()
+		if err != nil {
+			log.Errorf("Failed to reload config(%s): %s", reason, err)
+			return
+		}
+		// 起動時の設定(conf)は他の goroutine からも読むため書き換えず、ブリッジに反映済みの設定と比べる
+		old := bridge.config()
+		changed := changedConfigKeys(old, c)
+		if len(changed) == 0 {
+			log.Debugf("Config is not changed(%s)", reason)
+			return
+		}
+		log.Infof("Reloading config(%s): %v", reason, changed)
+
+		if c.APIBaseURL != old.APIBaseURL {
+			log.Warnf("api_base_url can't be changed without restart. Please restart hap-nature-remo to apply")
+			c.APIBaseURL = old.APIBaseURL
+		}
+		if c.LocalAPI != old.LocalAPI || c.LocalFailover != old.LocalFailover {
+			log.Warnf("local_api and local_failover can't be changed without restart. Please restart hap-nature-remo to apply")
+			c.LocalAPI = old.LocalAPI
+			c.LocalFailover = old.LocalFailover
+		}
+		// 前のアカウントの一覧が使われないよう、一覧を取得し直す(bridge.Reload)前にキャッシュを捨てる
+		if c.Token != old.Token {
+			nr.SetToken(c.Token)
+			util.ResetCache()
+		}
+		applyConfig(c)
+		bridge.Reload(c)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	file := filepath.Clean(viper.ConfigFileUsed())
+	var changes <-chan fsnotify.Event
+	var watchErrs <-chan error
+	if watcher, err := watchConfigFile(file); err != nil {
+		log.Warnf("Failed to watch config file(%s). Send SIGHUP to reload config: %s", file, err)
+	} else {
+		defer watcher.Close()
+		changes, watchErrs = watcher.Events, watcher.Errors
+	}
+	// Kubernetes の ConfigMap のように、シンボリックリンクの先が差し替えられた場合も変更とみなす
+	realFile, _ := filepath.EvalSymlinks(file)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload("SIGHUP")
+		case e := <-changes:
+			current, _ := filepath.EvalSymlinks(file)
+			written := filepath.Clean(e.Name) == file && e.Has(fsnotify.Write|fsnotify.Create)
+			if !written && (current == "" || current == realFile) {
+				continue
+			}
+			realFile = current
+			reload("file changed")
+		case err := <-watchErrs:
+			log.Warnf("Failed to watch config file(%s): %s", file, err)
+		}
+	}
+}
+
+// 設定ファイルの変更を監視する関数
+// (エディタなどは別のファイルに書いてから置き換えるため、ファイルのあるディレクトリを監視する)
+func watchConfigFile(file string) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// 変更された設定のキー
+func changedConfigKeys(old, new Config) []string {
+	var keys []string
+	ov := reflect.ValueOf(old)
+	nv := reflect.ValueOf(new)
+	for i := 0; i < ov.NumField(); i++ {
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		f := ov.Type().Field(i)
+		key := f.Tag.Get("mapstructure")
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"time"
+
+	"github.com/legnoh/hap-nature-remo/util"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -9,9 +12,42 @@ type Config struct {
 	Token string
 	Name  string `default:"hap-nature-remo"`
 	Pin   string `default:"12344321"`
-	Fans  []struct {
-		Nickname string
-	}
+	// Nature API の URL (fake-api などに向ける場合に指定する)
+	APIBaseURL string `mapstructure:"api_base_url"`
+	// Nature API レスポンスのキャッシュ期間
+	CacheTTL time.Duration `mapstructure:"cache_ttl" default:"10s"`
+	// ユーザー操作用に残しておく Nature API のリクエスト数
+	RateLimitReserve int64 `mapstructure:"rate_limit_reserve" default:"5"`
+	// 同じ家電への連続した操作をまとめるための送信間隔
+	CommandDebounce time.Duration `mapstructure:"command_debounce" default:"500ms"`
+	// Nature API 1リクエストあたりのタイムアウト
+	APITimeout time.Duration `mapstructure:"api_timeout" default:"10s"`
+	// Nature API が一時的に失敗した場合のリトライ回数
+	APIRetries int `mapstructure:"api_retries" default:"3"`
+	// Remo デバイスからの更新が途絶えたとみなし、障害として扱うまでの期間(0で無効)
+	DeviceStaleAfter time.Duration `mapstructure:"device_stale_after" default:"1h"`
+	// Nature API の接続状態を確認する間隔
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval" default:"1m"`
+	// 起動時に Nature API に接続できない場合、前回保存した一覧を使うまでリトライし続ける時間(0で保存した一覧があれば待たない)
+	StartupRetryTimeout time.Duration `mapstructure:"startup_retry_timeout"`
+	// デバイス・家電の追加・削除を確認する間隔(0で無効)
+	InventoryInterval time.Duration `mapstructure:"inventory_interval" default:"10m"`
+	// 終了時に送信待ちのコマンドを送り切るまで待つ最大時間
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" default:"10s"`
+	// 赤外線データを保存した信号を Remo のローカル API で送るかどうか(変更は再起動後に反映)
+	LocalAPI bool `mapstructure:"local_api"`
+	// Nature のクラウドの障害中だけ、赤外線データを保存した信号を Remo のローカル API で送るかどうか(変更は再起動後に反映)
+	LocalFailover bool `mapstructure:"local_failover"`
+	// ログのまとまり(api/hap/accessory)ごとのログレベル(--debug 指定時は全て debug)
+	LogLevels map[string]string `mapstructure:"log_levels"`
+	// 公開するデバイス・家電の条件(空の場合は全て)
+	Include []FilterRule
+	// 公開しないデバイス・家電の条件(include より優先)
+	Exclude []FilterRule
+	// 家電ごとの名前・カテゴリ・扱い方の上書き(家電 ID またはニックネームごと)
+	Appliances map[string]ApplianceOverride
+	// Remo デバイスごとのセンサーの値の補正(デバイス ID または名前ごと)
+	Sensors map[string]SensorOverride
 }
 
 var (
@@ -20,9 +56,12 @@ var (
 	confDir          string
 	fsStoreDirectory string
 	resetFs          bool
+	recordDir        string
+	replayDir        string
 	version          string
 	debug            bool
-	log              *logrus.Logger
+	logFormat        string
+	log              *logrus.Entry
 )
 
 var rootCmd = &cobra.Command{
@@ -38,15 +77,16 @@ to quickly create a Cobra application.`,
 }
 
 func Execute() {
-	log = logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 	if rootCmd.Execute() != nil {
 		log.Fatal("Root execute is failed... exit")
 	}
 }
 
 func init() {
+	log = util.Logger(util.ComponentHAP)
+
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "print debug log")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", util.LogFormatText, "log format (text|json)")
 	cobra.OnInitialize(initConfig)
 }
 
@@ -55,7 +95,12 @@ func initConfig() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := util.SetLogFormat(logFormat); err != nil {
+		log.Fatal(err)
+	}
 	if debug {
-		log.SetLevel(logrus.DebugLevel)
+		for _, c := range util.LogComponents() {
+			util.SetLogLevel(util.Component(c), logrus.DebugLevel.String())
+		}
 	}
 }
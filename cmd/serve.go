@@ -2,27 +2,15 @@ package cmd
 
 import (
 	"context"
-	"net"
+	"net/url"
 	"os"
 	"os/signal"
-	"regexp"
 	"syscall"
-	"time"
 
 	"github.com/brutella/hap"
-	"github.com/brutella/hap/accessory"
-	"github.com/creasty/defaults"
-	"github.com/legnoh/hap-nature-remo/additionalaccessory"
 	"github.com/legnoh/hap-nature-remo/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"github.com/tenntenn/natureremo"
-)
-
-type A []*accessory.A
-
-var (
-	accessories A
 )
 
 var serveCmd = &cobra.Command{
@@ -48,6 +36,10 @@ func init() {
 	serveCmd.Flags().StringVarP(&cfgFile, "config", "c", confDir+"/config.yml", "config file path")
 	serveCmd.Flags().StringVarP(&fsStoreDirectory, "fs-store", "f", confDir+"/db", "fsStore directory path")
 	serveCmd.Flags().BoolVar(&resetFs, "reset", false, "reset fsStore before start")
+	serveCmd.Flags().StringVar(&irCacheDirectory, "ir-cache", confDir+"/ir", "raw IR data directory path for the local API")
+	serveCmd.Flags().StringVar(&recordDir, "record", "", "record Nature API traffic to the directory")
+	serveCmd.Flags().StringVar(&replayDir, "replay", "", "replay recorded Nature API traffic from the directory instead of the cloud")
+	serveCmd.MarkFlagsMutuallyExclusive("record", "replay")
 }
 
 func preStartServer(cmd *cobra.Command, args []string) {
@@ -55,15 +47,12 @@ func preStartServer(cmd *cobra.Command, args []string) {
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatal(err)
 	}
-	if err := viper.Unmarshal(&conf); err != nil {
-		log.Fatal(err)
-	}
-	if err := defaults.Set(&conf); err != nil {
+	c, err := loadConfig()
+	if err != nil {
 		log.Fatal(err)
 	}
-	if !regexp.MustCompile(`^[0-9]{8}$`).MatchString(conf.Pin) {
-		log.Fatalf("Your PinCode(%s) is invalid format. Please fix to 8-digit code(e.g. 12344321)", conf.Pin)
-	}
+	conf = c
+	applyConfig(conf)
 
 	if resetFs {
 		err := os.RemoveAll(fsStoreDirectory)
@@ -74,81 +63,96 @@ func preStartServer(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// 起動直後など、DNS解決ができないタイミングで自動起動した際の挙動をコントロールするため、
-	// api.nature.global が解決できるようになるまで10秒ずつ待つ
-	dnsLookup := false
-	for !dnsLookup {
-		log.Debug("DNS resolve check start")
-		if _, err := net.LookupIP("api.nature.global"); err != nil {
-			log.Warnf("DNS resolve check failed: %s", err)
-			time.Sleep(10 * time.Second)
+	if replayDir != "" {
+		log.Infof("Replaying Nature API traffic from %s", replayDir)
+		return
+	}
+
+	// 起動直後など DNS 解決やネットワークが使えない間は、一覧の取得(loadInventory)がリトライし、
+	// 保存した一覧があればそれで起動するため、ここでは接続を待たない
+	if conf.APIBaseURL != "" {
+		if _, err := url.Parse(conf.APIBaseURL); err != nil {
+			log.Fatalf("Your api_base_url(%s) is invalid: %s", conf.APIBaseURL, err)
 		}
-		dnsLookup = true
 	}
-	log.Info("DNS resolve check successfully")
 }
 
 func startServer(cmd *cobra.Command, args []string) {
 
-	// ブリッジ作成
-	bridge := accessory.NewBridge(accessory.Info{
-		Name:         conf.Name,
-		Manufacturer: "@legnoh",
-		Model:        version,
-	})
-
-	// Natureデバイス一覧を取得
-	nr := natureremo.NewClient(conf.Token)
-	nrDevices := util.GetDevices(nr)
-
-	// センサーが1つでもあった場合はSensorアプライアンスを作る
-	for _, device := range nrDevices.Devices {
-		if len(device.NewestEvents) != 0 {
-			log.Infof("Sensor device detected: %s", device.Name)
-			a := additionalaccessory.NewSensor(nr, device)
-			accessories = append(accessories, a.A)
+	nr := util.NewClient(conf.Token, conf.RateLimitReserve)
+	if conf.APIBaseURL != "" {
+		nr.BaseURL = conf.APIBaseURL
+	}
+	switch {
+	case recordDir != "":
+		rec, err := util.NewRecorder(recordDir, conf.Token)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
 		}
+		nr.SetTransport(rec)
+		log.Infof("Recording Nature API traffic to %s", recordDir)
+	case replayDir != "":
+		rep, err := util.NewReplayer(replayDir)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		nr.SetTransport(rep)
 	}
 
-	// NatureRemoに登録済の家電一覧を取得し、全ての家電から操作可能なものを登録していく
-	for _, appliance := range util.GetAppliances(nr).Appliances {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		// リモコン式ファンがある場合はFanアプライアンスを作る
-		if appliance.Type == natureremo.ApplianceTypeIR && appliance.Image == "ico_fan" {
-			log.Infof("Compatible Appliance Found: %s(%s)", appliance.Nickname, appliance.ID)
-			a := additionalaccessory.NewFan(nr, appliance)
-			accessories = append(accessories, a.A)
+	// 赤外線データを保存してある信号は、 LAN 上の Remo に直接送る
+	// (local_failover の場合はクラウドの障害中のみ。再生時はクラウドに送ったことにする)
+	var client util.NatureClient = nr
+	if (conf.LocalAPI || conf.LocalFailover) && replayDir == "" {
+		cache, err := util.NewIRCache(irCacheDirectory)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
 		}
-
-		// エアコン(NatureRemo対応のもの)がある場合はAirConditionerアプライアンスを作る
-		if appliance.Type == natureremo.ApplianceTypeAirCon {
-			log.Infof("Compatible Appliance Found: %s(%s)", appliance.Nickname, appliance.ID)
-			a := additionalaccessory.NewAirConditioner(nr, appliance, nrDevices.Devices)
-			accessories = append(accessories, a.A)
+		mode := util.LocalModePrefer
+		if !conf.LocalAPI {
+			mode = util.LocalModeFailover
+		}
+		local := util.NewLocalClient(nr, cache, mode)
+		go func() {
+			if err := local.Discover(ctx); err != nil {
+				log.Warnf("Failed to discover Nature Remo on local network: %s", err)
+			}
+		}()
+		go local.WatchFailover(ctx)
+		client = local
+		if mode == util.LocalModeFailover {
+			log.Infof("Sending captured IR signals over local API during Nature cloud outages: %s", irCacheDirectory)
+		} else {
+			log.Infof("Sending captured IR signals over local API: %s", irCacheDirectory)
 		}
 	}
 
-	server, err := hap.NewServer(hap.NewFsStore(fsStoreDirectory), bridge.A, accessories...)
+	bridge, err := NewBridge(ctx, conf, client, hap.NewFsStore(fsStoreDirectory))
 	if err != nil {
 		log.Fatalf("Error: %s", err)
 	}
-	server.Pin = conf.Pin
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		<-c
-		log.Info("Stopping HAP Server...")
-		signal.Stop(c)
-		cancel()
-	}()
+	go util.WatchHealth(ctx, nr)
+	go watchConfig(ctx, bridge, nr)
 
 	log.Info("Starting HAP Server...")
-	log.Infof("Device Name: %s", bridge.Name())
+	log.Infof("Device Name: %s", conf.Name)
 	log.Infof("   Pin Code: %s", conf.Pin)
 	log.Debugf("Config File: %s", cfgFile)
 	log.Debugf(" Store Path: %s", fsStoreDirectory)
-	server.ListenAndServe(ctx)
+
+	// 終了シグナルを受けたら、送信待ちのコマンドを送り切ってから止める
+	// (終了処理中にもう一度シグナルを受けた場合はすぐに終了する)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Info("Stopping HAP Server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), bridge.config().ShutdownTimeout)
+		defer cancel()
+		bridge.Shutdown(shutdownCtx)
+	}()
+	if err := bridge.ListenAndServe(context.Background()); err != nil {
+		log.Fatalf("Error: %s", err)
+	}
 }
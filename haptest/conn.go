@@ -0,0 +1,101 @@
+package haptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/brutella/hap/chacha20poly1305"
+	"github.com/brutella/hap/hkdf"
+)
+
+// pair-verify 後の暗号化された接続
+// (フレームは [長さ(2byte)] [暗号文] [MAC(16byte)] の形式で、長さを追加データとして認証する)
+type secureConn struct {
+	net.Conn
+
+	writeKey   [32]byte
+	readKey    [32]byte
+	writeCount uint64
+	readCount  uint64
+	readBuf    bytes.Buffer
+}
+
+func newSecureConn(conn net.Conn, shared [32]byte) (*secureConn, error) {
+	// コントローラーから見た書き込み/読み込みの鍵(アクセサリー側と逆になる)
+	writeKey, err := hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Write-Encryption-Key"))
+	if err != nil {
+		return nil, err
+	}
+	readKey, err := hkdf.Sha512(shared[:], []byte("Control-Salt"), []byte("Control-Read-Encryption-Key"))
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{
+		Conn:     conn,
+		writeKey: writeKey,
+		readKey:  readKey,
+	}, nil
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	for i := 0; i < len(b); i += frameLengthMax {
+		end := min(i+frameLengthMax, len(b))
+		frame := b[i:end]
+
+		length := make([]byte, 2)
+		binary.LittleEndian.PutUint16(length, uint16(len(frame)))
+		var nonce [8]byte
+		binary.LittleEndian.PutUint64(nonce[:], c.writeCount)
+		c.writeCount++
+
+		encrypted, mac, err := chacha20poly1305.EncryptAndSeal(c.writeKey[:], nonce[:], frame, length)
+		if err != nil {
+			return 0, err
+		}
+		out.Write(length)
+		out.Write(encrypted)
+		out.Write(mac[:])
+	}
+	if _, err := c.Conn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	if c.readBuf.Len() == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	return c.readBuf.Read(b)
+}
+
+func (c *secureConn) readFrame() error {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, length); err != nil {
+		return err
+	}
+	encrypted := make([]byte, binary.LittleEndian.Uint16(length))
+	if _, err := io.ReadFull(c.Conn, encrypted); err != nil {
+		return err
+	}
+	var mac [16]byte
+	if _, err := io.ReadFull(c.Conn, mac[:]); err != nil {
+		return err
+	}
+
+	var nonce [8]byte
+	binary.LittleEndian.PutUint64(nonce[:], c.readCount)
+	c.readCount++
+
+	decrypted, err := chacha20poly1305.DecryptAndVerify(c.readKey[:], nonce[:], encrypted, mac, length)
+	if err != nil {
+		return err
+	}
+	c.readBuf.Write(decrypted)
+	return nil
+}
@@ -0,0 +1,473 @@
+// haptest は HAP サーバーとペアリングし、実際の HAP プロトコルでキャラクタリスティックを読み書きする
+// テスト用の HomeKit コントローラーと、ブリッジを偽の Nature API に繋いで起動するハーネスを提供するパッケージです。
+package haptest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/chacha20poly1305"
+	"github.com/brutella/hap/curve25519"
+	"github.com/brutella/hap/hkdf"
+	"github.com/brutella/hap/tlv8"
+	"github.com/tadglines/go-pkgs/crypto/srp"
+)
+
+const (
+	methodPair = 0
+
+	// 管理者のペアリング
+	permissionAdmin = 1
+
+	// HAP の暗号化フレームの最大長
+	frameLengthMax = 0x400
+
+	// 1回のリクエストの送信からレスポンスを読み終えるまでの期限
+	// (サーバーが応答しない場合に、テストが止まったままにならないようにする)
+	requestTimeout = 10 * time.Second
+)
+
+// pair-setup/pair-verify のレスポンスの TLV8
+type pairPayload struct {
+	Salt          []byte `tlv8:"2,optional"`
+	PublicKey     []byte `tlv8:"3,optional"`
+	Proof         []byte `tlv8:"4,optional"`
+	EncryptedData []byte `tlv8:"5,optional"`
+	State         byte   `tlv8:"6,optional"`
+	Error         byte   `tlv8:"7,optional"`
+}
+
+// HAP サーバーとペアリングして、キャラクタリスティックを読み書きするコントローラー
+type Controller struct {
+	addr string
+	pin  string
+
+	id      string
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+
+	mu   sync.Mutex
+	conn *secureConn
+	rd   *bufio.Reader
+}
+
+// addr で待ち受けている HAP サーバーに繋ぐコントローラーを作る
+// (pin は "12344321" の8桁の形式)
+func NewController(addr, pin string) (*Controller, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Controller{
+		addr:    addr,
+		pin:     pin,
+		id:      "haptest-controller",
+		public:  public,
+		private: private,
+	}, nil
+}
+
+// pair-setup を行い、コントローラーをサーバーに登録する
+func (c *Controller) Pair() error {
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	// M1 -> M2: SRP のソルトとサーバーの公開鍵を受け取る
+	m2, err := postTLV(conn, rd, "/pair-setup", 1, struct {
+		Method byte `tlv8:"0"`
+		State  byte `tlv8:"6"`
+	}{methodPair, 1})
+	if err != nil {
+		return fmt.Errorf("pair-setup M1: %w", err)
+	}
+
+	s, err := srp.NewSRP("rfc5054.3072", sha512.New, srpKeyDerivative([]byte("Pair-Setup")))
+	if err != nil {
+		return err
+	}
+	cs := s.NewClientSession([]byte("Pair-Setup"), []byte(fmtPin(c.pin)))
+	shared, err := cs.ComputeKey(m2.Salt, m2.PublicKey)
+	if err != nil {
+		return fmt.Errorf("pair-setup M2: %w", err)
+	}
+
+	// M3 -> M4: 互いの SRP の証明を検証する
+	m4, err := postTLV(conn, rd, "/pair-setup", 3, struct {
+		Method    byte   `tlv8:"0"`
+		PublicKey []byte `tlv8:"3"`
+		Proof     []byte `tlv8:"4"`
+		State     byte   `tlv8:"6"`
+	}{methodPair, cs.GetA(), cs.ComputeAuthenticator(), 3})
+	if err != nil {
+		return fmt.Errorf("pair-setup M3: %w", err)
+	}
+	if !cs.VerifyServerAuthenticator(m4.Proof) {
+		return errors.New("pair-setup M4: invalid server proof")
+	}
+
+	// M5 -> M6: コントローラーの長期公開鍵を署名付きで送る
+	encKey, err := hkdf.Sha512(shared, []byte("Pair-Setup-Encrypt-Salt"), []byte("Pair-Setup-Encrypt-Info"))
+	if err != nil {
+		return err
+	}
+	signKey, err := hkdf.Sha512(shared, []byte("Pair-Setup-Controller-Sign-Salt"), []byte("Pair-Setup-Controller-Sign-Info"))
+	if err != nil {
+		return err
+	}
+	var info []byte
+	info = append(info, signKey[:]...)
+	info = append(info, c.id...)
+	info = append(info, c.public...)
+
+	sub, err := tlv8.Marshal(struct {
+		Identifier string `tlv8:"1"`
+		PublicKey  []byte `tlv8:"3"`
+		Signature  []byte `tlv8:"10"`
+	}{c.id, c.public, ed25519.Sign(c.private, info)})
+	if err != nil {
+		return err
+	}
+	encrypted, mac, err := chacha20poly1305.EncryptAndSeal(encKey[:], []byte("PS-Msg05"), sub, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := postTLV(conn, rd, "/pair-setup", 5, struct {
+		Method        byte   `tlv8:"0"`
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}{methodPair, append(encrypted, mac[:]...), 5}); err != nil {
+		return fmt.Errorf("pair-setup M5: %w", err)
+	}
+	return nil
+}
+
+// pair-setup を行わずに、コントローラーをペアリング済みの管理者として store に登録する
+// (pair-setup は mDNS の TXT レコードを書き換え、dnssd の応答処理と競合するため、起動前に登録しておく)
+func (c *Controller) Register(store hap.Store) error {
+	b, err := json.Marshal(hap.Pairing{Name: c.id, PublicKey: c.public, Permission: permissionAdmin})
+	if err != nil {
+		return err
+	}
+	// hap の fsStore と同じく、名前を16進数にしたキーで保存する
+	return store.Set(hex.EncodeToString([]byte(c.id))+".pairing", b)
+}
+
+// pair-verify を行い、以降の通信を暗号化したセッションを張る
+func (c *Controller) Verify() error {
+	conn, err := net.DialTimeout("tcp", c.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReader(conn)
+
+	// M1 -> M2: 一時鍵を交換する
+	public, private := curve25519.GenerateKeyPair()
+	m2, err := postTLV(conn, rd, "/pair-verify", 1, struct {
+		Method    byte   `tlv8:"0"`
+		PublicKey []byte `tlv8:"3"`
+		State     byte   `tlv8:"6"`
+	}{methodPair, public[:], 1})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("pair-verify M1: %w", err)
+	}
+	var accessoryPublic [32]byte
+	copy(accessoryPublic[:], m2.PublicKey)
+	shared := curve25519.SharedSecret(private, accessoryPublic)
+
+	encKey, err := hkdf.Sha512(shared[:], []byte("Pair-Verify-Encrypt-Salt"), []byte("Pair-Verify-Encrypt-Info"))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// M3 -> M4: 長期鍵で署名して自分が誰かを証明する
+	var info []byte
+	info = append(info, public[:]...)
+	info = append(info, c.id...)
+	info = append(info, m2.PublicKey...)
+	sub, err := tlv8.Marshal(struct {
+		Identifier string `tlv8:"1"`
+		Signature  []byte `tlv8:"10"`
+	}{c.id, ed25519.Sign(c.private, info)})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	encrypted, mac, err := chacha20poly1305.EncryptAndSeal(encKey[:], []byte("PV-Msg03"), sub, nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := postTLV(conn, rd, "/pair-verify", 3, struct {
+		Method        byte   `tlv8:"0"`
+		EncryptedData []byte `tlv8:"5"`
+		State         byte   `tlv8:"6"`
+	}{methodPair, append(encrypted, mac[:]...), 3}); err != nil {
+		conn.Close()
+		return fmt.Errorf("pair-verify M3: %w", err)
+	}
+
+	sc, err := newSecureConn(conn, shared)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = sc
+	c.rd = bufio.NewReader(sc)
+	return nil
+}
+
+// セッションを閉じる
+func (c *Controller) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// HAP サーバーが返すアクセサリー一覧
+type Accessory struct {
+	Aid      uint64    `json:"aid"`
+	Services []Service `json:"services"`
+}
+
+type Service struct {
+	Iid             uint64           `json:"iid"`
+	Type            string           `json:"type"`
+	Characteristics []Characteristic `json:"characteristics"`
+}
+
+type Characteristic struct {
+	Iid         uint64      `json:"iid"`
+	Type        string      `json:"type"`
+	Value       interface{} `json:"value"`
+	Permissions []string    `json:"perms"`
+	Format      string      `json:"format"`
+	ValidValues []int       `json:"valid-values"`
+	MinValue    interface{} `json:"minValue"`
+	MaxValue    interface{} `json:"maxValue"`
+	StepValue   interface{} `json:"minStep"`
+}
+
+// 指定した種類のサービスのキャラクタリスティックを探す
+func (a Accessory) Characteristic(serviceType, characteristicType string) (Characteristic, bool) {
+	for _, s := range a.Services {
+		if s.Type != serviceType {
+			continue
+		}
+		for _, ch := range s.Characteristics {
+			if ch.Type == characteristicType {
+				return ch, true
+			}
+		}
+	}
+	return Characteristic{}, false
+}
+
+// アクセサリー情報の名前
+func (a Accessory) Name() string {
+	// AccessoryInformation(3E) の Name(23)
+	if ch, found := a.Characteristic("3E", "23"); found {
+		if name, ok := ch.Value.(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// GET /accessories でアクセサリー一覧を取得する
+func (c *Controller) Accessories() ([]Accessory, error) {
+	var resp struct {
+		Accessories []Accessory `json:"accessories"`
+	}
+	if err := c.do(http.MethodGet, "/accessories", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Accessories, nil
+}
+
+// 名前でアクセサリーを探す
+func (c *Controller) Accessory(name string) (Accessory, error) {
+	as, err := c.Accessories()
+	if err != nil {
+		return Accessory{}, err
+	}
+	for _, a := range as {
+		if a.Name() == name {
+			return a, nil
+		}
+	}
+	return Accessory{}, fmt.Errorf("accessory %q not found", name)
+}
+
+// 読み書きするキャラクタリスティックの値
+type characteristicValue struct {
+	Aid    uint64      `json:"aid"`
+	Iid    uint64      `json:"iid"`
+	Value  interface{} `json:"value,omitempty"`
+	Status int         `json:"status,omitempty"`
+}
+
+// GET /characteristics でキャラクタリスティックの現在値を読む
+// (サーバー側の ValueRequestFunc が呼ばれる)
+func (c *Controller) Get(aid, iid uint64) (interface{}, error) {
+	var resp struct {
+		Characteristics []characteristicValue `json:"characteristics"`
+	}
+	if err := c.do(http.MethodGet, fmt.Sprintf("/characteristics?id=%d.%d", aid, iid), nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Characteristics) != 1 {
+		return nil, fmt.Errorf("unexpected response: %+v", resp)
+	}
+	if status := resp.Characteristics[0].Status; status != 0 {
+		return nil, fmt.Errorf("hap status %d", status)
+	}
+	return resp.Characteristics[0].Value, nil
+}
+
+// PUT /characteristics でキャラクタリスティックに値を書き込む
+// (Home アプリからの操作と同じく、サーバー側のリモート更新の処理が呼ばれる)
+func (c *Controller) Put(aid, iid uint64, value interface{}) error {
+	body := struct {
+		Characteristics []characteristicValue `json:"characteristics"`
+	}{
+		Characteristics: []characteristicValue{{Aid: aid, Iid: iid, Value: value}},
+	}
+	return c.do(http.MethodPut, "/characteristics", body, nil)
+}
+
+// 暗号化したセッション上で JSON のリクエストを送る
+func (c *Controller) do(method, path string, body interface{}, v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errors.New("not verified")
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://"+c.addr+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/hap+json")
+	if err := c.conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return err
+	}
+	if err := req.Write(c.conn); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(c.rd, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if v == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+// 平文の接続で TLV8 を POST し、レスポンスを読む
+func postTLV(conn net.Conn, rd *bufio.Reader, path string, state byte, payload interface{}) (pairPayload, error) {
+	b, err := tlv8.Marshal(payload)
+	if err != nil {
+		return pairPayload{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+conn.RemoteAddr().String()+path, bytes.NewReader(b))
+	if err != nil {
+		return pairPayload{}, err
+	}
+	req.Header.Set("Content-Type", "application/pairing+tlv8")
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return pairPayload{}, err
+	}
+	if err := req.Write(conn); err != nil {
+		return pairPayload{}, err
+	}
+
+	resp, err := http.ReadResponse(rd, req)
+	if err != nil {
+		return pairPayload{}, err
+	}
+	defer resp.Body.Close()
+
+	var res pairPayload
+	if err := tlv8.UnmarshalReader(resp.Body, &res); err != nil {
+		return pairPayload{}, err
+	}
+	if res.Error != 0 {
+		return res, fmt.Errorf("tlv8 error %d", res.Error)
+	}
+	if res.State != state+1 {
+		return res, fmt.Errorf("unexpected state %d", res.State)
+	}
+	return res, nil
+}
+
+// HAP の SRP で使う鍵導出関数 x = H(s | H(I | ":" | P))
+func srpKeyDerivative(id []byte) srp.KeyDerivationFunc {
+	return func(salt, pin []byte) []byte {
+		h := sha512.New()
+		h.Write(id)
+		h.Write([]byte(":"))
+		h.Write(pin)
+		t := h.Sum(nil)
+		h.Reset()
+		h.Write(salt)
+		h.Write(t)
+		return h.Sum(nil)
+	}
+}
+
+// 12344321 -> 123-44-321
+func fmtPin(pin string) string {
+	if len(pin) != 8 {
+		return pin
+	}
+	return pin[:3] + "-" + pin[3:5] + "-" + pin[5:]
+}
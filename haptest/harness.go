@@ -0,0 +1,141 @@
+package haptest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/creasty/defaults"
+	"github.com/legnoh/hap-nature-remo/cmd"
+	"github.com/legnoh/hap-nature-remo/natureremotest"
+	"github.com/legnoh/hap-nature-remo/util"
+)
+
+// 偽の Nature API に繋いだブリッジと、ペアリング済みのコントローラーの組
+type Harness struct {
+	API        *natureremotest.Server
+	Bridge     *cmd.Bridge
+	Controller *Controller
+	// fsStore のディレクトリ(Close で削除する)
+	StoreDir string
+	// HAP サーバーの待ち受けアドレス
+	Addr string
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// フィクスチャを返す偽の Nature API と一時ディレクトリの fsStore で serve と同じブリッジを起動し、
+// ペアリング済みとして登録し、セッション確立まで済ませたコントローラーを繋ぐ関数
+func Start(fixtures *natureremotest.Fixtures, conf cmd.Config) (*Harness, error) {
+	if err := defaults.Set(&conf); err != nil {
+		return nil, err
+	}
+
+	h := &Harness{
+		API: natureremotest.NewServer(fixtures),
+	}
+	if conf.Token != "" {
+		h.API.Token = conf.Token
+	}
+
+	dir, err := os.MkdirTemp("", "haptest")
+	if err != nil {
+		h.API.Close()
+		return nil, err
+	}
+	h.StoreDir = dir
+
+	// 前のハーネスのキャッシュが残らないようにする
+	util.ResetCache()
+	util.SetCacheTTL(conf.CacheTTL)
+
+	h.Addr, err = freeAddr()
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.Controller, err = NewController(h.Addr, conf.Pin)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	store := hap.NewFsStore(dir)
+	if err := h.Controller.Register(store); err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	nr := util.NewClient(conf.Token, conf.RateLimitReserve)
+	nr.BaseURL = h.API.BaseURL()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.Bridge, err = cmd.NewBridge(ctx, conf, nr, store)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	h.Bridge.Addr = h.Addr
+
+	h.done = make(chan error, 1)
+	go func() {
+		h.done <- h.Bridge.ListenAndServe(ctx)
+	}()
+	if err := waitListening(h.Addr, h.done); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if err := h.Controller.Verify(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// ブリッジ・偽の API を止め、fsStore を削除する
+func (h *Harness) Close() error {
+	if h.Controller != nil {
+		h.Controller.Close()
+	}
+	if h.cancel != nil {
+		h.cancel()
+	}
+	if h.done != nil {
+		<-h.done
+	}
+	h.API.Close()
+	return os.RemoveAll(h.StoreDir)
+}
+
+// 空いているポートのアドレスを探す
+func freeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// サーバーが待ち受けを始めるまで待つ
+func waitListening(addr string, done chan error) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-done:
+			done <- err
+			return err
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("hap server did not start")
+}
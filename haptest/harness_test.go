@@ -0,0 +1,139 @@
+package haptest
+
+import (
+	"testing"
+
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/legnoh/hap-nature-remo/cmd"
+	"github.com/legnoh/hap-nature-remo/natureremotest"
+)
+
+func start(t *testing.T) *Harness {
+	t.Helper()
+	fixtures, err := natureremotest.LoadFixtures("../natureremotest/testdata/fixtures.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := Start(fixtures, cmd.Config{Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestHarnessWrite(t *testing.T) {
+	tests := []struct {
+		name           string
+		accessory      string
+		service        string
+		characteristic string
+		value          interface{}
+		path           string
+		form           map[string]string
+	}{
+		{
+			name:           "aircon mode",
+			accessory:      "Living AirCon",
+			service:        service.TypeHeaterCooler,
+			characteristic: characteristic.TypeTargetHeaterCoolerState,
+			value:          characteristic.TargetHeaterCoolerStateHeat,
+			path:           "/1/appliances/appliance-aircon/aircon_settings",
+			form:           map[string]string{"operation_mode": "warm"},
+		},
+		{
+			name:           "aircon temperature",
+			accessory:      "Living AirCon",
+			service:        service.TypeHeaterCooler,
+			characteristic: characteristic.TypeCoolingThresholdTemperature,
+			value:          24,
+			path:           "/1/appliances/appliance-aircon/aircon_settings",
+			form:           map[string]string{"temperature": "24"},
+		},
+		{
+			name:           "fan speed",
+			accessory:      "Bedroom Fan",
+			service:        service.TypeFan,
+			characteristic: characteristic.TypeRotationSpeed,
+			value:          66,
+			path:           "/1/signals/signal-fan-2/send",
+		},
+		{
+			name:           "fan direction",
+			accessory:      "Bedroom Fan",
+			service:        service.TypeFan,
+			characteristic: characteristic.TypeRotationDirection,
+			value:          characteristic.RotationDirectionCounterclockwise,
+			path:           "/1/signals/signal-fan-rotate/send",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := start(t)
+			a, err := h.Controller.Accessory(tt.accessory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch, found := a.Characteristic(tt.service, tt.characteristic)
+			if !found {
+				t.Fatalf("characteristic %s.%s was not found", tt.service, tt.characteristic)
+			}
+			if err := h.Controller.Put(a.Aid, ch.Iid, tt.value); err != nil {
+				t.Fatal(err)
+			}
+
+			cmds := h.API.Commands()
+			if len(cmds) != 1 {
+				t.Fatalf("commands = %+v, want 1", cmds)
+			}
+			if cmds[0].Path != tt.path {
+				t.Errorf("path = %s, want %s", cmds[0].Path, tt.path)
+			}
+			for k, v := range tt.form {
+				if got := cmds[0].Form.Get(k); got != v {
+					t.Errorf("form[%s] = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestHarnessRead(t *testing.T) {
+	h := start(t)
+
+	tests := []struct {
+		accessory      string
+		service        string
+		characteristic string
+		want           interface{}
+	}{
+		{"Living Remo", service.TypeTemperatureSensor, characteristic.TypeCurrentTemperature, 24.5},
+		{"Living Remo", service.TypeHumiditySensor, characteristic.TypeCurrentRelativeHumidity, 48.0},
+		{"Living AirCon", service.TypeHeaterCooler, characteristic.TypeCurrentTemperature, 24.5},
+		{"Living AirCon", service.TypeHeaterCooler, characteristic.TypeTargetHeaterCoolerState, float64(characteristic.TargetHeaterCoolerStateCool)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accessory+"/"+tt.characteristic, func(t *testing.T) {
+			a, err := h.Controller.Accessory(tt.accessory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch, found := a.Characteristic(tt.service, tt.characteristic)
+			if !found {
+				t.Fatalf("characteristic %s.%s was not found", tt.service, tt.characteristic)
+			}
+			v, err := h.Controller.Get(a.Aid, ch.Iid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tt.want {
+				t.Errorf("value = %v(%T), want %v", v, v, tt.want)
+			}
+		})
+	}
+	// 読み出しでは操作を送らない
+	if cmds := h.API.Commands(); len(cmds) != 0 {
+		t.Errorf("commands = %+v, want none", cmds)
+	}
+}
@@ -0,0 +1,189 @@
+// naturefake は Nature API をメモリ上で再現する util.NatureClient を提供するパッケージです。
+// アクセサリーを実際のクラウドに接続せずに動かす際に使います。
+package naturefake
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+// Client が受け取った操作の記録
+type Command struct {
+	ApplianceID    string
+	Signal         *natureremo.Signal
+	AirConSettings *natureremo.AirConSettings
+	Button         string
+}
+
+// メモリ上のデバイス・家電を返し、受け取った操作を記録する util.NatureClient
+type Client struct {
+	mu sync.Mutex
+
+	Devices    []*natureremo.Device
+	Appliances []*natureremo.Appliance
+	// 家電IDごとの信号一覧
+	Signals map[string][]*natureremo.Signal
+	// nil でない場合、全ての呼び出しでこのエラーを返す
+	Err error
+
+	commands []Command
+}
+
+var _ util.NatureClient = (*Client)(nil)
+
+func NewClient(devices []*natureremo.Device, appliances []*natureremo.Appliance) *Client {
+	return &Client{
+		Devices:    devices,
+		Appliances: appliances,
+		Signals:    map[string][]*natureremo.Signal{},
+	}
+}
+
+// 呼び出しで返すエラーを設定する
+func (c *Client) SetErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Err = err
+}
+
+// 返すデバイス一覧を差し替える(センサーの値の変化を再現する)
+func (c *Client) SetDevices(devices []*natureremo.Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Devices = devices
+}
+
+// これまでに受け取った操作の一覧
+func (c *Client) Commands() []Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Command(nil), c.commands...)
+}
+
+func (c *Client) GetDevices(ctx context.Context) ([]*natureremo.Device, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return slices.Clone(c.Devices), nil
+}
+
+func (c *Client) GetAppliances(ctx context.Context) ([]*natureremo.Appliance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return slices.Clone(c.Appliances), nil
+}
+
+func (c *Client) GetSignals(ctx context.Context, appliance *natureremo.Appliance) ([]*natureremo.Signal, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if signals, found := c.Signals[appliance.ID]; found {
+		return signals, nil
+	}
+	return appliance.Signals, nil
+}
+
+// 設定を記録し、保持している家電の状態にも反映する
+// (これまでに返した家電が書き換わらないよう、反映した家電は複製して差し替える)
+func (c *Client) UpdateAirConSettings(ctx context.Context, appliance *natureremo.Appliance, settings *natureremo.AirConSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return c.Err
+	}
+	s := *settings
+	c.commands = append(c.commands, Command{ApplianceID: appliance.ID, AirConSettings: &s})
+
+	for i, ap := range c.Appliances {
+		if ap.ID != appliance.ID {
+			continue
+		}
+		updated := *ap
+		current := natureremo.AirConSettings{}
+		if ap.AirConSettings != nil {
+			current = *ap.AirConSettings
+		}
+		if s.Temperature != "" {
+			current.Temperature = s.Temperature
+		}
+		if s.OperationMode != "" {
+			current.OperationMode = s.OperationMode
+		}
+		if s.AirVolume != "" {
+			current.AirVolume = s.AirVolume
+		}
+		if s.AirDirection != "" {
+			current.AirDirection = s.AirDirection
+		}
+		current.Button = s.Button
+		updated.AirConSettings = &current
+		c.Appliances[i] = &updated
+	}
+	return nil
+}
+
+func (c *Client) SendSignal(ctx context.Context, signal *natureremo.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return c.Err
+	}
+	c.commands = append(c.commands, Command{ApplianceID: c.applianceOf(signal), Signal: signal})
+	return nil
+}
+
+func (c *Client) SendLightSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.LightState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	c.commands = append(c.commands, Command{ApplianceID: appliance.ID, Button: button})
+	if appliance.Light != nil && appliance.Light.State != nil {
+		return appliance.Light.State, nil
+	}
+	return &natureremo.LightState{}, nil
+}
+
+func (c *Client) SendTVSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.TVState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	c.commands = append(c.commands, Command{ApplianceID: appliance.ID, Button: button})
+	if appliance.TV != nil && appliance.TV.State != nil {
+		return appliance.TV.State, nil
+	}
+	return &natureremo.TVState{}, nil
+}
+
+// 信号がどの家電のものかを探す(見つからない場合は空文字)
+func (c *Client) applianceOf(signal *natureremo.Signal) string {
+	for id, signals := range c.Signals {
+		for _, s := range signals {
+			if s.ID == signal.ID {
+				return id
+			}
+		}
+	}
+	for _, ap := range c.Appliances {
+		for _, s := range ap.Signals {
+			if s.ID == signal.ID {
+				return ap.ID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,286 @@
+// natureremotest は Nature Remo Cloud API を再現するテスト用の HTTP サーバーを提供するパッケージです。
+// YAML のフィクスチャからデバイス・家電を読み込み、受け取った操作を全て記録します。
+package natureremotest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+	"go.yaml.in/yaml/v3"
+)
+
+// サーバーが返すデバイス・家電・信号の一覧
+// (キー名は Nature API の JSON と同じものを使う)
+type Fixtures struct {
+	Devices    []*natureremo.Device            `json:"devices"`
+	Appliances []*natureremo.Appliance         `json:"appliances"`
+	Signals    map[string][]*natureremo.Signal `json:"signals"`
+	User       *natureremo.User                `json:"user"`
+}
+
+// YAML ファイルからフィクスチャを読み込む関数
+func LoadFixtures(path string) (*Fixtures, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFixtures(b)
+}
+
+// YAML からフィクスチャを読み込む関数
+// (natureremo の構造体は json タグしか持たないため、一度 JSON に変換してから読み込む)
+func ParseFixtures(b []byte) (*Fixtures, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	j, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var f Fixtures
+	if err := json.Unmarshal(j, &f); err != nil {
+		return nil, err
+	}
+	if f.Signals == nil {
+		f.Signals = map[string][]*natureremo.Signal{}
+	}
+	return &f, nil
+}
+
+// サーバーが受け取ったリクエストの記録
+type Request struct {
+	Method string
+	Path   string
+	Form   url.Values
+	Time   time.Time
+}
+
+// Nature API のうち、このアプリで使うエンドポイントを再現する http.Handler
+type Handler struct {
+	// 空でない場合、Authorization ヘッダのトークンを検証する
+	Token string
+	// レスポンスの X-Rate-Limit-* ヘッダに入れる値
+	RateLimit int64
+	Remaining int64
+
+	mu       sync.Mutex
+	fixtures *Fixtures
+	requests []Request
+	mux      *http.ServeMux
+}
+
+func NewHandler(f *Fixtures) *Handler {
+	h := &Handler{
+		RateLimit: 30,
+		Remaining: 30,
+		fixtures:  f,
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /1/users/me", h.getUser)
+	h.mux.HandleFunc("GET /1/devices", h.getDevices)
+	h.mux.HandleFunc("GET /1/appliances", h.getAppliances)
+	h.mux.HandleFunc("GET /1/appliances/{id}/signals", h.getSignals)
+	h.mux.HandleFunc("POST /1/appliances/{id}/aircon_settings", h.postAirConSettings)
+	h.mux.HandleFunc("POST /1/appliances/{id}/light", h.postButton)
+	h.mux.HandleFunc("POST /1/appliances/{id}/tv", h.postButton)
+	h.mux.HandleFunc("POST /1/signals/{id}/send", h.postSignal)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Token != "" && r.Header.Get("Authorization") != "Bearer "+h.Token {
+		writeError(w, http.StatusUnauthorized, 401001, "Unauthorized")
+		return
+	}
+	r.ParseForm()
+
+	h.mu.Lock()
+	h.requests = append(h.requests, Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Form:   r.PostForm,
+		Time:   time.Now(),
+	})
+	w.Header().Set("X-Rate-Limit-Limit", strconv.FormatInt(h.RateLimit, 10))
+	w.Header().Set("X-Rate-Limit-Remaining", strconv.FormatInt(h.Remaining, 10))
+	w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(5*time.Minute).Unix(), 10))
+	h.mu.Unlock()
+
+	h.mux.ServeHTTP(w, r)
+}
+
+// これまでに受け取った全てのリクエスト
+func (h *Handler) Requests() []Request {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Request(nil), h.requests...)
+}
+
+// これまでに受け取った操作(POST)のリクエスト
+func (h *Handler) Commands() []Request {
+	var cmds []Request
+	for _, r := range h.Requests() {
+		if r.Method == http.MethodPost {
+			cmds = append(cmds, r)
+		}
+	}
+	return cmds
+}
+
+func (h *Handler) getUser(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	user := h.fixtures.User
+	if user == nil {
+		user = &natureremo.User{ID: "natureremotest", Nickname: "natureremotest"}
+	}
+	writeJSON(w, user)
+}
+
+func (h *Handler) getDevices(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeJSON(w, nonNil(h.fixtures.Devices))
+}
+
+func (h *Handler) getAppliances(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeJSON(w, nonNil(h.fixtures.Appliances))
+}
+
+func (h *Handler) getSignals(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ap := h.appliance(r.PathValue("id"))
+	if ap == nil {
+		writeError(w, http.StatusNotFound, 404001, "Not Found")
+		return
+	}
+	if signals, found := h.fixtures.Signals[ap.ID]; found {
+		writeJSON(w, nonNil(signals))
+		return
+	}
+	writeJSON(w, nonNil(ap.Signals))
+}
+
+func (h *Handler) postAirConSettings(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ap := h.appliance(r.PathValue("id"))
+	if ap == nil || ap.Type != natureremo.ApplianceTypeAirCon {
+		writeError(w, http.StatusNotFound, 404001, "Not Found")
+		return
+	}
+	if ap.AirConSettings == nil {
+		ap.AirConSettings = &natureremo.AirConSettings{}
+	}
+	if v := r.PostForm.Get("temperature"); v != "" {
+		ap.AirConSettings.Temperature = v
+	}
+	if v := r.PostForm.Get("operation_mode"); v != "" {
+		ap.AirConSettings.OperationMode = natureremo.OperationMode(v)
+	}
+	if v := r.PostForm.Get("air_volume"); v != "" {
+		ap.AirConSettings.AirVolume = natureremo.AirVolume(v)
+	}
+	if v := r.PostForm.Get("air_direction"); v != "" {
+		ap.AirConSettings.AirDirection = natureremo.AirDirection(v)
+	}
+	ap.AirConSettings.Button = natureremo.Button(r.PostForm.Get("button"))
+	writeJSON(w, ap.AirConSettings)
+}
+
+func (h *Handler) postButton(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ap := h.appliance(r.PathValue("id"))
+	if ap == nil {
+		writeError(w, http.StatusNotFound, 404001, "Not Found")
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/tv") {
+		writeJSON(w, natureremo.TVState{})
+		return
+	}
+	writeJSON(w, natureremo.LightState{LastButton: r.PostForm.Get("button")})
+}
+
+func (h *Handler) postSignal(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := r.PathValue("id")
+	for _, signals := range h.fixtures.Signals {
+		for _, s := range signals {
+			if s.ID == id {
+				writeJSON(w, struct{}{})
+				return
+			}
+		}
+	}
+	for _, ap := range h.fixtures.Appliances {
+		for _, s := range ap.Signals {
+			if s.ID == id {
+				writeJSON(w, struct{}{})
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, 404001, "Not Found")
+}
+
+func (h *Handler) appliance(id string) *natureremo.Appliance {
+	for _, ap := range h.fixtures.Appliances {
+		if ap.ID == id {
+			return ap
+		}
+	}
+	return nil
+}
+
+// Handler を httptest.Server で動かすテスト用サーバー
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// フィクスチャを返すサーバーを起動する関数
+func NewServer(f *Fixtures) *Server {
+	h := NewHandler(f)
+	return &Server{
+		Server:  httptest.NewServer(h),
+		Handler: h,
+	}
+}
+
+// natureremo.Client.BaseURL に設定する URL
+func (s *Server) BaseURL() string {
+	return s.URL + "/1"
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(natureremo.APIError{Code: code, Message: message})
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package natureremotest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/tenntenn/natureremo"
+)
+
+func newClient(t *testing.T, token string) (*Server, *natureremo.Client) {
+	t.Helper()
+	f, err := LoadFixtures("testdata/fixtures.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(f)
+	t.Cleanup(s.Close)
+	s.Token = "token"
+	nr := natureremo.NewClient(token)
+	nr.BaseURL = s.BaseURL()
+	return s, nr
+}
+
+func TestServerFixtures(t *testing.T) {
+	_, nr := newClient(t, "token")
+	ctx := context.Background()
+
+	devices, err := nr.DeviceService.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].ID != "device-living" {
+		t.Fatalf("devices = %+v", devices)
+	}
+	if te := devices[0].NewestEvents[natureremo.SensorTypeTemperature]; te.Value != 24.5 {
+		t.Errorf("temperature = %g, want 24.5", te.Value)
+	}
+	// 指定していない updated_at を作らない
+	if !devices[1].UpdatedAt.IsZero() {
+		t.Errorf("updated_at = %s, want zero", devices[1].UpdatedAt)
+	}
+
+	appliances, err := nr.ApplianceService.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(appliances) != 2 || appliances[1].ID != "appliance-fan" || len(appliances[1].Signals) != 5 {
+		t.Fatalf("appliances = %+v", appliances)
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	s, nr := newClient(t, "token")
+	ctx := context.Background()
+
+	appliances, err := nr.ApplianceService.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac, fan := appliances[0], appliances[1]
+
+	settings := &natureremo.AirConSettings{OperationMode: natureremo.OperationModeWarm, Temperature: "22"}
+	if err := nr.ApplianceService.UpdateAirConSettings(ctx, ac, settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := nr.SignalService.Send(ctx, fan.Signals[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		form map[string]string
+	}{
+		{"/1/appliances/appliance-aircon/aircon_settings", map[string]string{"operation_mode": "warm", "temperature": "22"}},
+		{"/1/signals/signal-fan-1/send", nil},
+	}
+	cmds := s.Commands()
+	if len(cmds) != len(tests) {
+		t.Fatalf("commands = %+v, want %d", cmds, len(tests))
+	}
+	for i, tt := range tests {
+		if cmds[i].Path != tt.path {
+			t.Errorf("commands[%d].Path = %s, want %s", i, cmds[i].Path, tt.path)
+		}
+		for k, v := range tt.form {
+			if got := cmds[i].Form.Get(k); got != v {
+				t.Errorf("commands[%d].Form[%s] = %q, want %q", i, k, got, v)
+			}
+		}
+	}
+	// GET も含めて全てのリクエストを記録する
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+
+	// 操作した設定は以降の一覧に反映する
+	appliances, err = nr.ApplianceService.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := appliances[0].AirConSettings; got.OperationMode != natureremo.OperationModeWarm || got.Temperature != "22" {
+		t.Errorf("settings = %+v, want warm 22", got)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		call   func(context.Context, *natureremo.Client) error
+		status int
+	}{
+		{"wrong token", "wrong", func(ctx context.Context, nr *natureremo.Client) error {
+			_, err := nr.DeviceService.GetAll(ctx)
+			return err
+		}, http.StatusUnauthorized},
+		{"unknown signal", "token", func(ctx context.Context, nr *natureremo.Client) error {
+			return nr.SignalService.Send(ctx, &natureremo.Signal{ID: "unknown"})
+		}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, nr := newClient(t, tt.token)
+			err := tt.call(context.Background(), nr)
+			var apiErr *natureremo.APIError
+			if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+				t.Errorf("err = %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// APIレスポンスをTTLの間保持するキャッシュ
+// (API のリクエスト残量が少ない時は、TTLを引き延ばしてリクエストを減らす)
+// (TTL切れの状態で同時に取得要求が来た場合は、1つのリクエストにまとめて結果を共有する)
+type cache[T any] struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	value     T
+	updatedAt time.Time
+	lastErr   error
+	inflight  chan struct{}
+	// 取得に成功するたびに呼ばれる関数
+	onRefresh func()
+}
+
+func newCache[T any](ttl time.Duration) *cache[T] {
+	return &cache[T]{ttl: ttl}
+}
+
+// キャッシュが有効であればその値を、切れていれば fetch で取得した値を返す
+// (取得に失敗した場合はエラーと共に前回の値を返す)
+// 取得処理は複数の呼び出し元で共有するため ctx のキャンセルからは切り離し、
+// ctx がキャンセルされた呼び出し元だけが待つのをやめる
+func (c *cache[T]) get(ctx context.Context, fetch func(context.Context) (T, error)) (T, time.Time, error) {
+	c.mu.Lock()
+	if !c.updatedAt.IsZero() && time.Since(c.updatedAt) < pollInterval(c.ttl) {
+		defer c.mu.Unlock()
+		return c.value, c.updatedAt, nil
+	}
+
+	// 既に他のリクエストが取得中の場合は、その完了を待って結果を共有する
+	ch := c.inflight
+	if ch == nil {
+		ch = make(chan struct{})
+		c.inflight = ch
+		go c.refresh(context.WithoutCancel(ctx), ch, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.value, c.updatedAt, ctx.Err()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value, c.updatedAt, c.lastErr
+}
+
+func (c *cache[T]) refresh(ctx context.Context, ch chan struct{}, fetch func(context.Context) (T, error)) {
+	value, err := fetch(ctx)
+
+	c.mu.Lock()
+	if err == nil {
+		c.value = value
+		c.updatedAt = time.Now()
+	}
+	c.lastErr = err
+	c.inflight = nil
+	onRefresh := c.onRefresh
+	c.mu.Unlock()
+
+	if err == nil && onRefresh != nil {
+		onRefresh()
+	}
+	close(ch)
+}
+
+func (c *cache[T]) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+}
+
+func (c *cache[T]) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero T
+	c.value = zero
+	c.updatedAt = time.Time{}
+	c.lastErr = nil
+}
+
+func (c *cache[T]) seed(value T, updatedAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = value
+	c.updatedAt = updatedAt
+}
+
+// 最後に取得に成功してからの経過時間(一度も取得していない場合は0)
+func (c *cache[T]) age() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updatedAt.IsZero() {
+		return 0
+	}
+	return time.Since(c.updatedAt)
+}
+
+// API を呼ばずに最後に取得した値を返す
+func (c *cache[T]) peek() (T, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value, c.updatedAt
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// リクエスト残量で間隔を引き延ばさないよう、他のテストで作った RateLimiter を外す
+func withoutQuota(t *testing.T) {
+	t.Helper()
+	prev := quota
+	quota = nil
+	t.Cleanup(func() { quota = prev })
+}
+
+// TTL 切れの状態で同時に取得要求が来た場合は、1回の取得の結果を全員で共有する
+func TestCacheGetCoalesces(t *testing.T) {
+	withoutQuota(t)
+	c := newCache[int](time.Hour)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fetch := func(context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make(chan int, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, _, err := c.get(context.Background(), fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- v
+		}()
+	}
+	// 全員が取得中の結果を待ち始めてから取得を終わらせる
+	for deadline := time.Now().Add(time.Second); calls.Load() == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		if v != 42 {
+			t.Errorf("value = %d, want 42", v)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fetch called %d times, want 1", got)
+	}
+
+	// TTL の間は取得し直さない
+	if v, _, err := c.get(context.Background(), fetch); err != nil || v != 42 {
+		t.Errorf("cached = %d(%v), want 42", v, err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fetch called %d times within TTL, want 1", got)
+	}
+}
+
+// 取得に失敗した場合は前回の値とエラーを返し、次の要求で取得し直す
+func TestCacheGetError(t *testing.T) {
+	withoutQuota(t)
+	c := newCache[int](time.Hour)
+	updatedAt := time.Now().Add(-2 * time.Hour)
+	c.seed(1, updatedAt)
+	down := errors.New("down")
+
+	v, at, err := c.get(context.Background(), func(context.Context) (int, error) { return 0, down })
+	if !errors.Is(err, down) || v != 1 || !at.Equal(updatedAt) {
+		t.Errorf("get = %d, %s, %v, want 1, %s, %v", v, at, err, updatedAt, down)
+	}
+	v, _, err = c.get(context.Background(), func(context.Context) (int, error) { return 2, nil })
+	if err != nil || v != 2 {
+		t.Errorf("get after recovery = %d(%v), want 2", v, err)
+	}
+}
+
+// 呼び出し元がキャンセルしても取得は続け、他の呼び出し元は結果を受け取れる
+func TestCacheGetCanceledCaller(t *testing.T) {
+	withoutQuota(t)
+	c := newCache[int](time.Hour)
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (int, error) {
+		<-release
+		return 7, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, _, err := c.get(ctx, fetch)
+		canceled <- err
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		inflight := c.inflight != nil
+		c.mu.Unlock()
+		if inflight {
+			break
+		}
+	}
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller err = %v, want %v", err, context.Canceled)
+	}
+
+	waiting := make(chan int, 1)
+	go func() {
+		v, _, _ := c.get(context.Background(), fetch)
+		waiting <- v
+	}()
+	close(release)
+	if v := <-waiting; v != 7 {
+		t.Errorf("value = %d, want 7", v)
+	}
+}
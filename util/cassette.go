@@ -0,0 +1,238 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 記録した Nature API のリクエストとレスポンスの組
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// 記録するレスポンスヘッダ
+var recordedHeaders = []string{
+	"Content-Type",
+	"X-Rate-Limit-Limit",
+	"X-Rate-Limit-Remaining",
+	"X-Rate-Limit-Reset",
+}
+
+// Nature API とのやり取りをディレクトリに記録する http.RoundTripper
+// (Authorization ヘッダは記録せず、本文中のトークンも伏せ字にする)
+type Recorder struct {
+	// 実際に通信を行う RoundTripper (nil の場合は http.DefaultTransport)
+	Transport http.RoundTripper
+
+	dir string
+	mu  sync.Mutex
+	seq int
+	// 伏せ字にするトークン(設定の再読み込みでトークンが変わっても伏せられるよう、リクエストで使われたものも加える)
+	tokens []string
+}
+
+func NewRecorder(dir string, token string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	r := &Recorder{dir: dir}
+	r.addToken(token)
+	return r, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); found {
+		r.addToken(token)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		reqBody = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	header := http.Header{}
+	for _, k := range recordedHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	it := Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  req.URL.RawQuery,
+			Body:   r.redact(string(reqBody)),
+		},
+		Response: RecordedResponse{
+			Status: resp.StatusCode,
+			Header: header,
+			Body:   r.redact(string(respBody)),
+		},
+	}
+	if err := r.save(it); err != nil {
+		Logger(ComponentAPI).Warnf("Failed to record Nature API response: %s", err)
+	}
+	return resp, nil
+}
+
+func (r *Recorder) addToken(token string) {
+	if token == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.tokens, token) {
+		r.tokens = append(r.tokens, token)
+	}
+}
+
+func (r *Recorder) redact(s string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, token := range r.tokens {
+		s = strings.ReplaceAll(s, token, "REDACTED")
+	}
+	return s
+}
+
+func (r *Recorder) save(it Interaction) error {
+	b, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.seq++
+	name := fmt.Sprintf("%05d-%s%s.json", r.seq, it.Request.Method, strings.ReplaceAll(it.Request.Path, "/", "_"))
+	r.mu.Unlock()
+	return os.WriteFile(filepath.Join(r.dir, name), b, 0640)
+}
+
+// Recorder で記録したやり取りを、クラウドに接続せずに再生する http.RoundTripper
+// (同じリクエストが複数記録されている場合は記録順に返し、最後のものを返し続ける)
+type Replayer struct {
+	mu           sync.Mutex
+	interactions map[string][]Interaction
+	served       map[string]int
+	log          *logrus.Entry
+}
+
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded interactions in %s", dir)
+	}
+	sort.Strings(files)
+
+	log := Logger(ComponentAPI)
+	r := &Replayer{
+		interactions: map[string][]Interaction{},
+		served:       map[string]int{},
+		log:          log,
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var it Interaction
+		if err := json.Unmarshal(b, &it); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		key := replayKey(it.Request.Method, it.Request.Path, it.Request.Query)
+		r.interactions[key] = append(r.interactions[key], it)
+	}
+	return r, nil
+}
+
+func replayKey(method, path, query string) string {
+	return method + " " + path + "?" + query
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := replayKey(req.Method, req.URL.Path, req.URL.RawQuery)
+
+	r.mu.Lock()
+	its := r.interactions[key]
+	i := min(r.served[key], len(its)-1)
+	r.served[key]++
+	r.mu.Unlock()
+
+	// 記録にない操作は成功したものとして扱い、状態取得は見つからなかったものとして扱う
+	if len(its) == 0 {
+		r.log.Warnf("Not recorded Nature API request: %s", key)
+		if req.Method == http.MethodPost {
+			return replayResponse(req, http.StatusOK, http.Header{}, "{}"), nil
+		}
+		return replayResponse(req, http.StatusNotFound, http.Header{}, `{"code":404001,"message":"not recorded"}`), nil
+	}
+	r.log.Debugf("Replaying Nature API request: %s", key)
+	it := its[i]
+	return replayResponse(req, it.Response.Status, it.Response.Header.Clone(), it.Response.Body), nil
+}
+
+func replayResponse(req *http.Request, status int, header http.Header, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,61 @@
+package util_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/legnoh/hap-nature-remo/util"
+)
+
+// 設定の再読み込みでトークンが変わっても、記録にトークンが残らない
+func TestRecorderRedactsReloadedToken(t *testing.T) {
+	// 受け取ったトークンを本文に含めて返す Nature API
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Rate-Limit-Limit", "30")
+		w.Header().Set("X-Rate-Limit-Remaining", "29")
+		w.Header().Set("X-Rate-Limit-Reset", "1700000000")
+		fmt.Fprintf(w, `[{"id":"remo","name":"%s"}]`, token)
+	}))
+	defer api.Close()
+
+	dir := t.TempDir()
+	nr := util.NewClient("old-token", 0)
+	nr.BaseURL = api.URL
+	rec, err := util.NewRecorder(dir, "old-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nr.SetTransport(rec)
+
+	for _, token := range []string{"old-token", "new-token"} {
+		nr.SetToken(token)
+		if _, err := nr.GetDevices(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("recorded %d interactions, want 2", len(files))
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(b), "-token") {
+			t.Errorf("%s contains token:\n%s", filepath.Base(file), b)
+		}
+	}
+}
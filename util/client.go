@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// Nature API のうち、このアプリで使う操作をまとめたインターフェース
+// (アクセサリーはこのインターフェースを通して API を呼び出すため、テスト時は偽物に差し替えられる)
+type NatureClient interface {
+	GetDevices(ctx context.Context) ([]*natureremo.Device, error)
+	GetAppliances(ctx context.Context) ([]*natureremo.Appliance, error)
+	GetSignals(ctx context.Context, appliance *natureremo.Appliance) ([]*natureremo.Signal, error)
+	UpdateAirConSettings(ctx context.Context, appliance *natureremo.Appliance, settings *natureremo.AirConSettings) error
+	SendSignal(ctx context.Context, signal *natureremo.Signal) error
+	SendLightSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.LightState, error)
+	SendTVSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.TVState, error)
+}
+
+// Nature Remo Cloud API を呼び出す NatureClient
+type CloudClient struct {
+	*natureremo.Client
+
+	limiter *RateLimiter
+	token   atomic.Value
+}
+
+// アクセストークンを変更する関数(設定の再読み込み用)
+func (c *CloudClient) SetToken(token string) {
+	c.token.Store(token)
+}
+
+// リクエストごとに最新のアクセストークンを付ける http.RoundTripper
+type tokenTransport struct {
+	client *CloudClient
+	next   http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.client.token.Load().(string))
+	return t.next.RoundTrip(req)
+}
+
+// 実際に通信を行う RoundTripper を差し替える関数(API の記録・再生用)
+func (c *CloudClient) SetTransport(rt http.RoundTripper) {
+	c.limiter.Transport = rt
+}
+
+var _ NatureClient = (*CloudClient)(nil)
+
+func (c *CloudClient) GetDevices(ctx context.Context) ([]*natureremo.Device, error) {
+	return c.DeviceService.GetAll(ctx)
+}
+
+func (c *CloudClient) GetAppliances(ctx context.Context) ([]*natureremo.Appliance, error) {
+	return c.ApplianceService.GetAll(ctx)
+}
+
+func (c *CloudClient) GetSignals(ctx context.Context, appliance *natureremo.Appliance) ([]*natureremo.Signal, error) {
+	return c.SignalService.GetAll(ctx, appliance)
+}
+
+func (c *CloudClient) UpdateAirConSettings(ctx context.Context, appliance *natureremo.Appliance, settings *natureremo.AirConSettings) error {
+	return c.ApplianceService.UpdateAirConSettings(ctx, appliance, settings)
+}
+
+func (c *CloudClient) SendSignal(ctx context.Context, signal *natureremo.Signal) error {
+	return c.SignalService.Send(ctx, signal)
+}
+
+func (c *CloudClient) SendLightSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.LightState, error) {
+	return c.ApplianceService.SendLightSignal(ctx, appliance, button)
+}
+
+func (c *CloudClient) SendTVSignal(ctx context.Context, appliance *natureremo.Appliance, button string) (*natureremo.TVState, error) {
+	return c.ApplianceService.SendTVSignal(ctx, appliance, button)
+}
@@ -0,0 +1,174 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// Remo デバイスからの更新が途絶えたとみなすまでのデフォルトの期間
+const DefaultDeviceStaleAfter = time.Hour
+
+// 接続状態を確認するデフォルトの間隔
+const DefaultHealthCheckInterval = time.Minute
+
+var (
+	// アクセストークンが拒否された場合のエラー
+	ErrTokenRejected = errors.New("nature api rejected the access token")
+	// Remo デバイスが一覧に見つからない場合のエラー
+	ErrDeviceNotFound = errors.New("nature remo device was not found")
+	// Remo デバイスからの更新が途絶えている場合のエラー
+	ErrDeviceStale = errors.New("nature remo device data is stale")
+)
+
+// Nature API と Remo デバイスの接続状態
+// (状態が変わったら登録された関数を呼び、アクセサリーの StatusFault などを更新する)
+type cloudHealth struct {
+	mu         sync.Mutex
+	err        error
+	staleAfter time.Duration
+	interval   time.Duration
+	listeners  map[int]func()
+	next       int
+	log        *logrus.Entry
+}
+
+var health = newCloudHealth()
+
+func newCloudHealth() *cloudHealth {
+	log := Logger(ComponentAPI)
+	return &cloudHealth{
+		staleAfter: DefaultDeviceStaleAfter,
+		interval:   DefaultHealthCheckInterval,
+		listeners:  map[int]func(){},
+		log:        log,
+	}
+}
+
+// Remo デバイスからの更新が途絶えたとみなすまでの期間を変更する関数
+func SetDeviceStaleAfter(d time.Duration) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.staleAfter = d
+}
+
+// 接続状態を確認する間隔を変更する関数(確認中の場合は次の確認から反映する)
+func SetHealthCheckInterval(d time.Duration) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.interval = d
+}
+
+// 接続状態が変わる可能性がある時に呼ばれる関数を登録する
+// (戻り値の関数で登録を解除する)
+func OnHealthChange(fn func()) func() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	id := health.next
+	health.next++
+	health.listeners[id] = fn
+	return func() {
+		health.mu.Lock()
+		defer health.mu.Unlock()
+		delete(health.listeners, id)
+	}
+}
+
+// API 呼び出しの結果から接続状態を更新する
+// (リクエスト枠の温存や呼び出し元のキャンセルは障害として扱わない)
+func (h *cloudHealth) record(err error) {
+	if errors.Is(err, ErrQuotaReserved) || errors.Is(err, context.Canceled) {
+		return
+	}
+	var apiErr *natureremo.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPStatus == http.StatusUnauthorized {
+		err = fmt.Errorf("%w: %s", ErrTokenRejected, apiErr.Message)
+	}
+
+	h.mu.Lock()
+	prev := h.err
+	h.err = err
+	listeners := make([]func(), 0, len(h.listeners))
+	for _, fn := range h.listeners {
+		listeners = append(listeners, fn)
+	}
+	h.mu.Unlock()
+
+	if prev == nil && err != nil {
+		h.log.Warnf("Nature API is unavailable. Accessories are marked as fault: %s", err)
+	} else if prev != nil && err == nil {
+		h.log.Info("Nature API recovered.")
+	}
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// Nature API に接続できていない場合はその理由を返す関数
+func CloudFault() error {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return health.err
+}
+
+// Remo デバイスのデータが使えない場合はその理由を返す関数
+// (API を呼ばず、最後に取得した Device 一覧で判断する)
+func DeviceFault(id string) error {
+	if err := CloudFault(); err != nil {
+		return err
+	}
+	devices, updatedAt := devicesCache.peek()
+	if updatedAt.IsZero() {
+		return nil
+	}
+	for _, device := range devices {
+		if device.ID != id {
+			continue
+		}
+		health.mu.Lock()
+		staleAfter := health.staleAfter
+		health.mu.Unlock()
+		if lastSeen := DeviceLastSeen(device); staleAfter > 0 && !lastSeen.IsZero() && time.Since(lastSeen) > staleAfter {
+			return fmt.Errorf("%w: %s (last seen at %s)", ErrDeviceStale, device.Name, lastSeen.Format(time.DateTime))
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrDeviceNotFound, id)
+}
+
+// Remo デバイスが最後にセンサーの値を送ってきた時刻
+// (updated_at は設定の変更時刻で生存確認には使えないため、センサーのないデバイスはゼロ値を返す)
+func DeviceLastSeen(device *natureremo.Device) time.Time {
+	var lastSeen time.Time
+	for _, event := range device.NewestEvents {
+		if event.CreatedAt.After(lastSeen) {
+			lastSeen = event.CreatedAt
+		}
+	}
+	return lastSeen
+}
+
+// HomeKit からの読み取りがなくても障害からの復旧に気付けるよう、定期的に Device 一覧を取得する関数
+// (ctx がキャンセルされるまで戻らない)
+func WatchHealth(ctx context.Context, nr NatureClient) {
+	for {
+		health.mu.Lock()
+		interval := health.interval
+		health.mu.Unlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			GetDevices(ctx, nr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package util_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+func resetHealth(t *testing.T, nr *naturefake.Client) {
+	t.Helper()
+	reset := func() {
+		nr.SetErr(nil)
+		util.ResetCache()
+		util.GetDevices(context.Background(), nr)
+		util.ResetCache()
+		util.SetCacheTTL(util.DefaultCacheTTL)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// キャッシュを返しただけの呼び出しでは、接続状態を更新しない
+func TestHealthRecordsOnlyFetches(t *testing.T) {
+	nr := naturefake.NewClient([]*natureremo.Device{{DeviceCore: natureremo.DeviceCore{ID: "remo"}}}, nil)
+	resetHealth(t, nr)
+	util.SetCacheTTL(time.Hour)
+
+	var changes atomic.Int32
+	stop := util.OnHealthChange(func() { changes.Add(1) })
+	defer stop()
+
+	ctx := context.Background()
+	util.GetDevices(ctx, nr)
+	util.GetDevices(ctx, nr)
+	if n := changes.Load(); n != 1 {
+		t.Errorf("health changes = %d, want 1", n)
+	}
+
+	// キャッシュが有効な間は API の失敗に気付かない
+	nr.SetErr(&natureremo.APIError{HTTPStatus: http.StatusUnauthorized, Message: "Unauthorized"})
+	util.GetDevices(ctx, nr)
+	if err := util.CloudFault(); err != nil {
+		t.Errorf("CloudFault = %v, want nil", err)
+	}
+
+	util.ResetCache()
+	util.GetDevices(ctx, nr)
+	if err := util.CloudFault(); !errors.Is(err, util.ErrTokenRejected) {
+		t.Errorf("CloudFault = %v, want ErrTokenRejected", err)
+	}
+	if n := changes.Load(); n != 2 {
+		t.Errorf("health changes = %d, want 2", n)
+	}
+}
+
+func TestDeviceFault(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	event := func(at time.Time) map[natureremo.SensorType]natureremo.SensorValue {
+		return map[natureremo.SensorType]natureremo.SensorValue{
+			natureremo.SensorTypeTemperature: {Value: 24, CreatedAt: at},
+		}
+	}
+	devices := []*natureremo.Device{
+		{DeviceCore: natureremo.DeviceCore{ID: "stale", UpdatedAt: old}, NewestEvents: event(old)},
+		{DeviceCore: natureremo.DeviceCore{ID: "live", UpdatedAt: old}, NewestEvents: event(time.Now())},
+		{DeviceCore: natureremo.DeviceCore{ID: "nano", UpdatedAt: old}},
+	}
+
+	tests := []struct {
+		id   string
+		want error
+	}{
+		{"stale", util.ErrDeviceStale},
+		{"live", nil},
+		// センサーのないデバイスは updated_at が古くても障害にしない
+		{"nano", nil},
+		{"unknown", util.ErrDeviceNotFound},
+	}
+	nr := naturefake.NewClient(devices, nil)
+	resetHealth(t, nr)
+	util.GetDevices(context.Background(), nr)
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			err := util.DeviceFault(tt.id)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("DeviceFault = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
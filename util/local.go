@@ -0,0 +1,309 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// Remo がローカル API を公開している mDNS のサービス
+const RemoServiceType = "_remo._tcp.local."
+
+// ローカル API 1リクエストあたりのタイムアウト(届かない場合はすぐにクラウドに切り替える)
+const localTimeout = 3 * time.Second
+
+var (
+	// 信号の赤外線データが保存されていない場合のエラー
+	ErrIRNotCached = errors.New("raw ir data is not cached")
+	// 信号を登録している Remo が LAN 上に見つからない場合のエラー
+	ErrRemoNotFound = errors.New("nature remo was not found on the local network")
+)
+
+// 信号 ID ごとの赤外線データを、1信号1ファイルの JSON で保存しておくもの
+type IRCache struct {
+	dir string
+	mu  sync.Mutex
+	irs map[string]*natureremo.IRSignal
+}
+
+// ディレクトリに保存済みの赤外線データを読み込む関数
+func NewIRCache(dir string) (*IRCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &IRCache{dir: dir, irs: map[string]*natureremo.IRSignal{}}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var ir natureremo.IRSignal
+		if err := json.Unmarshal(b, &ir); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		c.irs[strings.TrimSuffix(filepath.Base(file), ".json")] = &ir
+	}
+	return c, nil
+}
+
+func (c *IRCache) Get(signalID string) (*natureremo.IRSignal, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ir, found := c.irs[signalID]
+	return ir, found
+}
+
+// 保存してある赤外線データの数
+func (c *IRCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.irs)
+}
+
+func (c *IRCache) Set(signalID string, ir *natureremo.IRSignal) error {
+	b, err := json.MarshalIndent(ir, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, signalID+".json"), b, 0o644); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.irs[signalID] = ir
+	return nil
+}
+
+// ローカル API をどのように使うか
+type LocalMode int
+
+const (
+	// 赤外線データを保存してある信号は常にローカル API で送る
+	LocalModePrefer LocalMode = iota
+	// 普段はクラウドで送り、クラウドの障害中だけローカル API で送る
+	LocalModeFailover
+)
+
+// 赤外線データを保存してある信号は Remo のローカル API で送り、
+// Remo に届いていないことが確かな場合はクラウドに送る NatureClient (信号送信以外はそのままクラウドを呼ぶ)
+type LocalClient struct {
+	NatureClient
+
+	mode LocalMode
+	ir   *IRCache
+	log  *logrus.Entry
+
+	mu sync.Mutex
+	// mDNS で見つけた Remo のアドレス(インスタンス名の MAC アドレス下6桁ごと)
+	remos map[string]string
+	// クラウドの障害でローカル API に切り替えている間の理由
+	outage error
+}
+
+func NewLocalClient(cloud NatureClient, ir *IRCache, mode LocalMode) *LocalClient {
+	return &LocalClient{
+		NatureClient: cloud,
+		mode:         mode,
+		ir:           ir,
+		log:          Logger(ComponentAPI).WithField("transport", "local"),
+		remos:        map[string]string{},
+	}
+}
+
+var _ NatureClient = (*LocalClient)(nil)
+
+func (c *LocalClient) SendSignal(ctx context.Context, signal *natureremo.Signal) error {
+	if c.mode == LocalModeFailover && c.Outage() == nil {
+		err := c.NatureClient.SendSignal(ctx, signal)
+		if err == nil || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		// クラウドに届かない場合は、接続状態の確認を待たずにローカル API に切り替える
+		c.failover(err)
+		// タイムアウトなど、クラウドに届いた可能性がある場合は、二重に送らないようローカル API では送り直さない
+		if !notDelivered(err) {
+			return err
+		}
+		if localErr := c.sendLocal(ctx, signal); localErr != nil {
+			c.log.Debugf("Failed to send signal over local API: %s(%s): %s", signal.Name, signal.ID, localErr)
+			return err
+		}
+		c.log.Debugf("Sent signal over local API: %s(%s)", signal.Name, signal.ID)
+		return nil
+	}
+
+	err := c.sendLocal(ctx, signal)
+	if err == nil {
+		c.log.Debugf("Sent signal over local API: %s(%s)", signal.Name, signal.ID)
+		return nil
+	}
+	// タイムアウトなど、Remo に届いた可能性がある場合は、二重に送らないようクラウドでは送り直さない
+	if !notDelivered(err) {
+		c.log.Warnf("Failed to send signal over local API: %s(%s): %s", signal.Name, signal.ID, err)
+		return err
+	}
+	if !errors.Is(err, ErrIRNotCached) {
+		c.log.Warnf("Failed to send signal over local API, falling back to cloud: %s(%s): %s", signal.Name, signal.ID, err)
+	}
+	return c.NatureClient.SendSignal(ctx, signal)
+}
+
+// 信号が送り先に届いていないと言い切れるエラーかどうか
+// (赤外線データがない・Remo が見つからない・接続できなかった場合のみで、接続した後のタイムアウトやエラーは含めない)
+func notDelivered(err error) bool {
+	if errors.Is(err, ErrIRNotCached) || errors.Is(err, ErrRemoNotFound) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// クラウドの障害でローカル API に切り替えている場合はその理由を返す関数
+func (c *LocalClient) Outage() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outage
+}
+
+// クラウドの障害を検知したら、信号の送信をローカル API に切り替える
+func (c *LocalClient) failover(err error) {
+	c.mu.Lock()
+	prev := c.outage
+	c.outage = err
+	c.mu.Unlock()
+	if prev == nil {
+		c.log.Warnf("Nature cloud is unavailable. Switching IR signals to local API(%d captured): %s", c.ir.Len(), err)
+	}
+}
+
+// クラウドが復旧したら、信号の送信をクラウドに戻す
+func (c *LocalClient) failback() {
+	c.mu.Lock()
+	prev := c.outage
+	c.outage = nil
+	c.mu.Unlock()
+	if prev != nil {
+		c.log.Info("Nature cloud recovered. Switching IR signals back to cloud")
+	}
+}
+
+// Nature API の接続状態に合わせて、クラウドとローカル API を切り替え続ける関数
+// (LocalModeFailover の場合のみ。 ctx がキャンセルされるまで戻らない)
+func (c *LocalClient) WatchFailover(ctx context.Context) {
+	if c.mode != LocalModeFailover {
+		return
+	}
+	update := func() {
+		if err := CloudFault(); err != nil {
+			c.failover(err)
+		} else {
+			c.failback()
+		}
+	}
+	stop := OnHealthChange(update)
+	defer stop()
+	<-ctx.Done()
+}
+
+func (c *LocalClient) sendLocal(ctx context.Context, signal *natureremo.Signal) error {
+	ir, found := c.ir.Get(signal.ID)
+	if !found {
+		return ErrIRNotCached
+	}
+	device := signalDevice(signal.ID)
+	if device == nil {
+		return fmt.Errorf("%w: device of signal %s is unknown", ErrRemoNotFound, signal.ID)
+	}
+	lc, err := c.Remo(device)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, localTimeout)
+	defer cancel()
+	return lc.Emit(ctx, ir)
+}
+
+// Remo のローカル API のクライアントを返す関数
+func (c *LocalClient) Remo(device *natureremo.DeviceCore) (*natureremo.LocalClient, error) {
+	c.mu.Lock()
+	addr, found := c.remos[macSuffix(device.MacAddress)]
+	c.mu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrRemoNotFound, device.Name)
+	}
+	return natureremo.NewLocalClient(addr), nil
+}
+
+// LAN 上の Remo を mDNS で探し続ける関数
+// (ctx がキャンセルされるまで戻らない)
+func (c *LocalClient) Discover(ctx context.Context) error {
+	add := func(e dnssd.BrowseEntry) {
+		if len(e.IPs) == 0 {
+			return
+		}
+		addr := net.JoinHostPort(e.IPs[0].String(), strconv.Itoa(e.Port))
+		c.mu.Lock()
+		c.remos[remoSuffix(e.Name)] = addr
+		c.mu.Unlock()
+		c.log.Infof("Nature Remo found on local network: %s(%s)", e.Name, addr)
+	}
+	rmv := func(e dnssd.BrowseEntry) {
+		c.mu.Lock()
+		delete(c.remos, remoSuffix(e.Name))
+		c.mu.Unlock()
+		c.log.Infof("Nature Remo disappeared from local network: %s", e.Name)
+	}
+	err := dnssd.LookupType(ctx, RemoServiceType, add, rmv)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// mDNS のインスタンス名(Remo-XXXXXX)から MAC アドレス下6桁を取り出す
+func remoSuffix(name string) string {
+	_, suffix, _ := strings.Cut(name, "-")
+	return strings.ToLower(suffix)
+}
+
+func macSuffix(mac string) string {
+	hex := strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(hex) < 6 {
+		return hex
+	}
+	return hex[len(hex)-6:]
+}
+
+// 信号を登録している家電の Remo デバイス(最後に取得した家電一覧から探す)
+func signalDevice(signalID string) *natureremo.DeviceCore {
+	appliances, _ := appliancesCache.peek()
+	for _, appliance := range appliances {
+		for _, signal := range appliance.Signals {
+			if signal.ID == signalID {
+				return appliance.Device
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// 信号の送信回数を数え、err を返すクラウドのクライアント
+type sendCounter struct {
+	NatureClient
+	sent atomic.Int32
+	err  error
+}
+
+func (c *sendCounter) SendSignal(ctx context.Context, signal *natureremo.Signal) error {
+	c.sent.Add(1)
+	return c.err
+}
+
+// 赤外線データを保存した信号と、その信号を登録した Remo を LAN 上に見つけた LocalClient を作る
+// (remoAddr が空の場合は Remo が見つからない)
+func newTestLocalClient(t *testing.T, cloud NatureClient, mode LocalMode, remoAddr string) (*LocalClient, *natureremo.Signal) {
+	t.Helper()
+	ResetCache()
+	t.Cleanup(ResetCache)
+	signal := &natureremo.Signal{ID: "power", Name: "Power"}
+	device := &natureremo.DeviceCore{ID: "remo", Name: "Living", MacAddress: "aa:bb:cc:dd:ee:ff"}
+	SeedCache(nil, []*natureremo.Appliance{{ID: "light", Device: device, Signals: []*natureremo.Signal{signal}}}, time.Now())
+
+	ir, err := NewIRCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ir.Set(signal.ID, &natureremo.IRSignal{Freq: 38, Data: []int64{100, 200}, Format: "us"}); err != nil {
+		t.Fatal(err)
+	}
+	c := NewLocalClient(cloud, ir, mode)
+	if remoAddr != "" {
+		c.remos["ddeeff"] = remoAddr
+	}
+	return c, signal
+}
+
+// 呼ばれた回数を数え、リクエストがキャンセルされるまで応答しない Remo
+func newHangingRemo(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var emitted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		emitted.Add(1)
+		// 本文を読み切るまでは、クライアントが切断してもリクエストがキャンセルされない
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), &emitted
+}
+
+// 接続を拒否する Remo のアドレス
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestNotDelivered(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"ir not cached", ErrIRNotCached, true},
+		{"remo not found", fmt.Errorf("%w: Living", ErrRemoNotFound), true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "api.nature.global"}, true},
+		{"timeout", context.DeadlineExceeded, false},
+		{"read timeout", &net.OpError{Op: "read", Err: errors.New("i/o timeout")}, false},
+		{"server error", &natureremo.APIError{HTTPStatus: http.StatusBadGateway}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notDelivered(tt.err); got != tt.want {
+				t.Errorf("notDelivered(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// ローカル API を優先する場合は、Remo に届いていないことが確かな場合だけクラウドで送り直す
+func TestLocalClientPreferFallback(t *testing.T) {
+	hanging, emitted := newHangingRemo(t)
+	tests := []struct {
+		name      string
+		remoAddr  string
+		wantErr   bool
+		wantCloud int32
+	}{
+		{name: "remo not found", wantCloud: 1},
+		{name: "connection refused", remoAddr: refusedAddr(t), wantCloud: 1},
+		{name: "timeout after sent", remoAddr: hanging, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud := &sendCounter{}
+			c, signal := newTestLocalClient(t, cloud, LocalModePrefer, tt.remoAddr)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			if err := c.SendSignal(ctx, signal); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if got := cloud.sent.Load(); got != tt.wantCloud {
+				t.Errorf("cloud sent = %d, want %d", got, tt.wantCloud)
+			}
+		})
+	}
+	if got := emitted.Load(); got != 1 {
+		t.Errorf("remo emitted = %d, want 1", got)
+	}
+}
+
+// クラウドの障害時にローカル API に切り替える場合も、クラウドに届いていないことが確かな場合だけ送り直す
+func TestLocalClientFailoverFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		cloudErr  error
+		wantErr   bool
+		wantLocal int32
+	}{
+		{name: "connection refused", cloudErr: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, wantErr: true, wantLocal: 1},
+		{name: "timeout", cloudErr: context.DeadlineExceeded, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remo, emitted := newHangingRemo(t)
+			cloud := &sendCounter{err: tt.cloudErr}
+			c, signal := newTestLocalClient(t, cloud, LocalModeFailover, remo)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			if err := c.SendSignal(ctx, signal); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if got := emitted.Load(); got != tt.wantLocal {
+				t.Errorf("remo emitted = %d, want %d", got, tt.wantLocal)
+			}
+			if c.Outage() == nil {
+				t.Error("Outage = nil, want switched to local API")
+			}
+		})
+	}
+}
+
+// LocalModeFailover の場合は、接続状態に合わせてクラウドとローカル API を切り替える
+func TestLocalClientWatchFailover(t *testing.T) {
+	c, _ := newTestLocalClient(t, &sendCounter{}, LocalModeFailover, "")
+	t.Cleanup(func() { health.record(nil) })
+	health.mu.Lock()
+	listeners := len(health.listeners)
+	health.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.WatchFailover(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		health.mu.Lock()
+		registered := len(health.listeners) > listeners
+		health.mu.Unlock()
+		if registered {
+			break
+		}
+	}
+
+	down := errors.New("down")
+	health.record(down)
+	if err := c.Outage(); !errors.Is(err, down) {
+		t.Errorf("Outage = %v, want %v", err, down)
+	}
+	health.record(nil)
+	if err := c.Outage(); err != nil {
+		t.Errorf("Outage after recovery = %v, want nil", err)
+	}
+
+	cancel()
+	<-done
+	// 監視を止めた後は切り替えない
+	health.record(down)
+	if err := c.Outage(); err != nil {
+		t.Errorf("Outage after stop = %v, want nil", err)
+	}
+}
+
+// LocalModePrefer の場合は接続状態を監視せずにすぐ戻る
+func TestLocalClientWatchFailoverPrefer(t *testing.T) {
+	c, _ := newTestLocalClient(t, &sendCounter{}, LocalModePrefer, "")
+	done := make(chan struct{})
+	go func() {
+		c.WatchFailover(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WatchFailover did not return")
+	}
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"fmt"
+	stdlog "log"
+	"sort"
+	"strings"
+
+	dnssdlog "github.com/brutella/dnssd/log"
+	haplog "github.com/brutella/hap/log"
+	"github.com/sirupsen/logrus"
+)
+
+// ログを出す機能のまとまり(まとまりごとにログレベルを変えられる)
+type Component string
+
+const (
+	// Nature API の呼び出し・接続状態
+	ComponentAPI Component = "api"
+	// HAP サーバー・ブリッジ(hap/dnssd ライブラリのログを含む)
+	ComponentHAP Component = "hap"
+	// 各アクセサリーの状態取得・操作
+	ComponentAccessory Component = "accessory"
+)
+
+// ログの形式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// 全てのまとまりで同じ出力先・形式を使い、ログレベルだけをまとまりごとに持つ
+var loggers = newLoggers()
+
+func newLoggers() map[Component]*logrus.Logger {
+	loggers := map[Component]*logrus.Logger{}
+	for _, c := range []Component{ComponentAPI, ComponentHAP, ComponentAccessory} {
+		l := logrus.New()
+		l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+		loggers[c] = l
+	}
+	return loggers
+}
+
+func init() {
+	// hap/dnssd ライブラリのログも HAP のログとして同じ形式で出す
+	hap := Logger(ComponentHAP)
+	for lib, ls := range map[string][2]*stdlog.Logger{
+		"hap":   {haplog.Info.Logger, haplog.Debug.Logger},
+		"dnssd": {dnssdlog.Info.Logger, dnssdlog.Debug.Logger},
+	} {
+		entry := hap.WithField("lib", lib)
+		for i, level := range []logrus.Level{logrus.InfoLevel, logrus.DebugLevel} {
+			ls[i].SetOutput(entry.WriterLevel(level))
+			ls[i].SetPrefix("")
+			ls[i].SetFlags(stdlog.Lshortfile)
+		}
+	}
+}
+
+// まとまりごとのロガーを返す関数
+// (出力する行には component フィールドがつく)
+func Logger(c Component) *logrus.Entry {
+	l, found := loggers[c]
+	if !found {
+		l = loggers[ComponentHAP]
+	}
+	return l.WithField("component", string(c))
+}
+
+// 全てのまとまりのログの形式(text/json)を変更する関数
+func SetLogFormat(format string) error {
+	var f logrus.Formatter
+	switch format {
+	case "", LogFormatText:
+		f = &logrus.TextFormatter{FullTimestamp: true}
+	case LogFormatJSON:
+		f = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format(%s): use %s or %s", format, LogFormatText, LogFormatJSON)
+	}
+	for _, l := range loggers {
+		l.SetFormatter(f)
+	}
+	return nil
+}
+
+// まとまりのログレベルを変更する関数
+func SetLogLevel(c Component, level string) error {
+	l, found := loggers[c]
+	if !found {
+		return fmt.Errorf("unknown log component(%s): use %s", c, strings.Join(LogComponents(), ", "))
+	}
+	lv, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.SetLevel(lv)
+	return nil
+}
+
+// ログレベルを変えられるまとまりの一覧
+func LogComponents() []string {
+	var cs []string
+	for c := range loggers {
+		cs = append(cs, string(c))
+	}
+	sort.Strings(cs)
+	return cs
+}
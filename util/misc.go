@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
 
@@ -8,21 +9,29 @@ import (
 	"github.com/tenntenn/natureremo"
 )
 
-func GetStepInfo(values []string) (float64, float64, float64) {
+// 設定可能な値の一覧から最小値・最大値・設定単位を求める関数
+// (値が2つ未満か数値でないものがある場合はエラー)
+func GetStepInfo(values []string) (float64, float64, float64, error) {
 
 	var steps []float64
 
 	for _, v := range values {
-		val, _ := strconv.ParseFloat(v, 64)
+		val, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid step value(%q): %w", v, err)
+		}
 		steps = append(steps, val)
 	}
+	if len(steps) < 2 {
+		return 0, 0, 0, fmt.Errorf("too few step values: %v", values)
+	}
 	sort.Float64s(sort.Float64Slice(steps))
 
 	min := steps[0]
 	max := steps[len(steps)-1]
 	step := steps[1] - steps[0]
 
-	return min, max, step
+	return min, max, step, nil
 }
 
 func SetBridgeFirmwareInfo(bridgeMeta accessory.Info, nd natureremo.DeviceCore) accessory.Info {
@@ -2,7 +2,8 @@ package util
 
 import (
 	"context"
-	"math/rand"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,100 +13,207 @@ import (
 type NrDevices struct {
 	Devices   []*natureremo.Device
 	UpdatedAt time.Time
+	// 取得に失敗した場合のエラー(Devices には前回取得できた値が入る)
+	Err error
 }
 
 type NrAppliances struct {
 	Appliances []*natureremo.Appliance
 	UpdatedAt  time.Time
+	// 取得に失敗した場合のエラー(Appliances には前回取得できた値が入る)
+	Err error
 }
 
+// Nature API レスポンスのデフォルトのキャッシュ期間
+const DefaultCacheTTL = 10 * time.Second
+
 var (
-	nrDevices    NrDevices
-	nrAppliances NrAppliances
+	devicesCache    = newCache[[]*natureremo.Device](DefaultCacheTTL)
+	appliancesCache = newCache[[]*natureremo.Appliance](DefaultCacheTTL)
+
+	refreshMu        sync.Mutex
+	refreshListeners = map[int]func([]*natureremo.Device, []*natureremo.Appliance){}
+	refreshNext      int
 )
 
-// NatureRemoの Appliance取得リクエストを行う関数
-// (大量のリクエストが走ることを防ぐため、10秒未満のリクエストの場合は前回のリクエスト結果を使う)
-func GetAppliances(nr *natureremo.Client) NrAppliances {
+func init() {
+	devicesCache.onRefresh = notifyRefresh
+	appliancesCache.onRefresh = notifyRefresh
+}
 
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+// Device/Appliance 一覧の取得に成功するたびに、最新の一覧を受け取る関数を登録する
+// (戻り値の関数で登録を解除する)
+func OnRefresh(fn func(devices []*natureremo.Device, appliances []*natureremo.Appliance)) func() {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	id := refreshNext
+	refreshNext++
+	refreshListeners[id] = fn
+	return func() {
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		delete(refreshListeners, id)
+	}
+}
 
-	nrctx := context.Background()
+// (Device/Appliance のどちらかをまだ取得できていない場合は呼ばない)
+func notifyRefresh() {
+	devices, devicesUpdatedAt := devicesCache.peek()
+	appliances, appliancesUpdatedAt := appliancesCache.peek()
+	if devicesUpdatedAt.IsZero() || appliancesUpdatedAt.IsZero() {
+		return
+	}
+	refreshMu.Lock()
+	listeners := make([]func([]*natureremo.Device, []*natureremo.Appliance), 0, len(refreshListeners))
+	for _, fn := range refreshListeners {
+		listeners = append(listeners, fn)
+	}
+	refreshMu.Unlock()
+	for _, fn := range listeners {
+		fn(devices, appliances)
+	}
+}
+
+// Device/Appliance 取得結果のキャッシュ期間を変更する関数
+func SetCacheTTL(ttl time.Duration) {
+	devicesCache.setTTL(ttl)
+	appliancesCache.setTTL(ttl)
+}
+
+// Device/Appliance 取得結果のキャッシュを捨てる関数
+func ResetCache() {
+	devicesCache.reset()
+	appliancesCache.reset()
+}
+
+// 保存しておいた Device/Appliance 一覧をキャッシュに入れる関数
+// (起動時に API に接続できない場合、前回の一覧を取得に失敗した時の値として使う)
+func SeedCache(devices []*natureremo.Device, appliances []*natureremo.Appliance, updatedAt time.Time) {
+	devicesCache.seed(devices, updatedAt)
+	appliancesCache.seed(appliances, updatedAt)
+}
 
-	now := time.Now()
-	delta := now.Sub(nrAppliances.UpdatedAt).Seconds()
-	log.Debugf("delta: %2f(%t)", delta, delta > 10)
+// 最後に Device 一覧の取得に成功してからの経過時間
+func DevicesCacheAge() time.Duration {
+	return devicesCache.age()
+}
 
-	if delta > 10 {
-		if aps, err := nr.ApplianceService.GetAll(nrctx); err != nil {
-			log.Error(err)
-			return nrAppliances
-		} else {
+// 最後に Appliance 一覧の取得に成功してからの経過時間
+func AppliancesCacheAge() time.Duration {
+	return appliancesCache.age()
+}
+
+// NatureRemoの Appliance取得リクエストを行う関数
+// (大量のリクエストが走ることを防ぐため、キャッシュ期間内のリクエストの場合は前回のリクエスト結果を使う)
+func GetAppliances(ctx context.Context, nr NatureClient) NrAppliances {
+
+	log := Logger(ComponentAPI)
+
+	aps, updatedAt, err := appliancesCache.get(ctx, func(ctx context.Context) ([]*natureremo.Appliance, error) {
+		var aps []*natureremo.Appliance
+		err := callAPI(ctx, "GetAppliances", true, func(ctx context.Context) (err error) {
+			aps, err = nr.GetAppliances(ctx)
+			return err
+		})
+		// キャッシュを返しただけの場合は接続状態を変えないよう、実際に取得した結果だけを記録する
+		health.record(err)
+		if err == nil {
 			log.Info("Get Latest Appliances Successful.")
-			nrAppliances = NrAppliances{
-				Appliances: aps,
-				UpdatedAt:  time.Now(),
-			}
-			return nrAppliances
 		}
+		return aps, err
+	})
+	if errors.Is(err, ErrQuotaReserved) {
+		log.Warnf("Using cached Appliances responses: %s", err)
+	} else if err != nil {
+		log.Error(err)
+	}
+	log.Debugf("Appliances cache age: %s", AppliancesCacheAge())
+	return NrAppliances{
+		Appliances: aps,
+		UpdatedAt:  updatedAt,
+		Err:        err,
 	}
-	log.Debugf("Using cached Appliances responses: %s", nrAppliances.UpdatedAt)
-	return nrAppliances
 }
 
 // NatureRemoの Device 取得リクエストを行う関数
-// (大量のリクエストが走ることを防ぐため、10秒未満のリクエストの場合は前回のリクエスト結果を使う)
-func GetDevices(nr *natureremo.Client) NrDevices {
-
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
-	nrctx := context.Background()
-	now := time.Now()
-
-	if now.Sub(nrDevices.UpdatedAt).Seconds() > 10 {
-		if dvs, err := nr.DeviceService.GetAll(nrctx); err != nil {
-			log.Error(err)
-			return nrDevices
-		} else {
+// (大量のリクエストが走ることを防ぐため、キャッシュ期間内のリクエストの場合は前回のリクエスト結果を使う)
+func GetDevices(ctx context.Context, nr NatureClient) NrDevices {
+
+	log := Logger(ComponentAPI)
+
+	dvs, updatedAt, err := devicesCache.get(ctx, func(ctx context.Context) ([]*natureremo.Device, error) {
+		var dvs []*natureremo.Device
+		err := callAPI(ctx, "GetDevices", true, func(ctx context.Context) (err error) {
+			dvs, err = nr.GetDevices(ctx)
+			return err
+		})
+		// キャッシュを返しただけの場合は接続状態を変えないよう、実際に取得した結果だけを記録する
+		health.record(err)
+		if err == nil {
 			log.Info("Get Latest Devices Successful.")
-			nrDevices = NrDevices{
-				Devices:   dvs,
-				UpdatedAt: time.Now(),
-			}
-			return nrDevices
 		}
+		return dvs, err
+	})
+	if errors.Is(err, ErrQuotaReserved) {
+		log.Warnf("Using cached Devices responses: %s", err)
+	} else if err != nil {
+		log.Error(err)
+	}
+	log.Debugf("Devices cache age: %s", DevicesCacheAge())
+	return NrDevices{
+		Devices:   dvs,
+		UpdatedAt: updatedAt,
+		Err:       err,
 	}
-	log.Debugf("Using cached Devices responses: %s", nrDevices.UpdatedAt)
-	return nrDevices
 }
 
-// エアコンのモード変更リクエストを行う関数
-func SendAirconRequest(nr *natureremo.Client, ac *natureremo.Appliance, mode *natureremo.AirConSettings) error {
-
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-	nrctx := context.Background()
-
-	// (リクエストを散らすため、5秒以内でランダム秒待つ処理を加える)
-	wait := rand.Intn(5)
-	log.Debugf("SendAirconRequest: Sleeping %d seconds...\n", wait)
-	time.Sleep(time.Duration(wait) * time.Second)
-
-	return nr.ApplianceService.UpdateAirConSettings(nrctx, ac, mode)
+// 家電に登録されている信号一覧を取得する関数
+func GetSignals(ctx context.Context, nr NatureClient, appliance *natureremo.Appliance) ([]*natureremo.Signal, error) {
+	var signals []*natureremo.Signal
+	err := callAPI(ctx, "GetSignals", true, func(ctx context.Context) (err error) {
+		signals, err = nr.GetSignals(ctx, appliance)
+		return err
+	})
+	return signals, err
 }
 
-func SendSignalRequest(nr *natureremo.Client, signal *natureremo.Signal) error {
-
-	log := logrus.New()
-	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-	nrctx := context.Background()
-
-	// (リクエストを散らすため、5秒以内でランダム秒待つ処理を加える)
-	wait := rand.Intn(5)
-	log.Debugf("SendSignalRequest: Sleeping %d seconds...\n", wait)
-	time.Sleep(time.Duration(wait) * time.Second)
+// エアコンのモード変更リクエストを行う関数
+// (同じエアコンへの変更が続いた場合は、1つのリクエストにまとめて送る)
+// 設定値をそのまま送るリクエストのため、一時的な失敗の場合はリトライする
+func SendAirconRequest(ctx context.Context, nr NatureClient, ac *natureremo.Appliance, mode *natureremo.AirConSettings) error {
+
+	log := Logger(ComponentAPI).WithFields(logrus.Fields{"appliance_id": ac.ID, "nickname": ac.Nickname})
+
+	settings := *mode
+	return commands.enqueue(ctx, ac.ID, &command{
+		name:   ac.Nickname,
+		group:  "aircon",
+		aircon: &settings,
+		send: func(ctx context.Context, c *command) error {
+			log.Debugf("%s: Send AirConSettings: %+v", ac.Nickname, *c.aircon)
+			return callAPI(WithPriority(ctx, PriorityCommand), "SendAirconRequest", true, func(ctx context.Context) error {
+				return nr.UpdateAirConSettings(ctx, ac, c.aircon)
+			})
+		},
+	})
+}
 
-	return nr.SignalService.Send(nrctx, signal)
+// 家電の信号送信リクエストを行う関数
+// (group が同じ信号が続いた場合は、最後の信号だけを送る)
+// group を持つ信号は状態を指定するもののためリトライし、トグル式の信号は二重送信を防ぐためリトライしない
+func SendSignalRequest(ctx context.Context, nr NatureClient, appliance *natureremo.Appliance, signal *natureremo.Signal, group string) error {
+
+	log := Logger(ComponentAPI).WithFields(logrus.Fields{"appliance_id": appliance.ID, "nickname": appliance.Nickname})
+
+	return commands.enqueue(ctx, appliance.ID, &command{
+		name:   appliance.Nickname,
+		group:  group,
+		signal: signal,
+		send: func(ctx context.Context, c *command) error {
+			log.Debugf("%s: Send Signal: %s(%s)", appliance.Nickname, c.signal.Name, c.signal.ID)
+			return callAPI(WithPriority(ctx, PriorityCommand), "SendSignalRequest", group != "", func(ctx context.Context) error {
+				return nr.SendSignal(ctx, c.signal)
+			})
+		},
+	})
 }
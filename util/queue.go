@@ -0,0 +1,241 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// 連続した操作をまとめるために、同じ種類のコマンドの送信間隔を空けるデフォルトの期間
+const DefaultCommandDebounce = 500 * time.Millisecond
+
+// 終了処理中でコマンドを受け付けられない場合のエラー
+var ErrShuttingDown = errors.New("command queue is shutting down")
+
+// 家電に送る1回分のコマンド
+type command struct {
+	// ログに出す家電の名前
+	name string
+	// 同じ group のコマンドが連続して送信待ちになった場合は1つにまとめる(空の場合はまとめない)
+	group  string
+	aircon *natureremo.AirConSettings
+	signal *natureremo.Signal
+	send   func(context.Context, *command) error
+	// 送信に使う context (まとめた場合は最後に来たコマンドのもの)
+	ctx     context.Context
+	waiters []chan error
+}
+
+func (c *command) String() string {
+	switch {
+	case c.aircon != nil:
+		return fmt.Sprintf("%s: AirConSettings %+v", c.name, *c.aircon)
+	case c.signal != nil:
+		return fmt.Sprintf("%s: Signal %s(%s)", c.name, c.signal.Name, c.signal.ID)
+	}
+	return c.name
+}
+
+// 後から来たコマンドの内容を送信待ちのコマンドに反映する
+func (c *command) merge(next *command) {
+	if c.aircon != nil && next.aircon != nil {
+		if next.aircon.Temperature != "" {
+			c.aircon.Temperature = next.aircon.Temperature
+		}
+		if next.aircon.OperationMode != "" {
+			c.aircon.OperationMode = next.aircon.OperationMode
+		}
+		if next.aircon.AirVolume != "" {
+			c.aircon.AirVolume = next.aircon.AirVolume
+		}
+		if next.aircon.AirDirection != "" {
+			c.aircon.AirDirection = next.aircon.AirDirection
+		}
+		// 電源ボタンは空(電源オン)も意味を持つため、常に後から来たものを使う
+		c.aircon.Button = next.aircon.Button
+	}
+	if next.signal != nil {
+		c.signal = next.signal
+	}
+	c.ctx = next.ctx
+	c.waiters = append(c.waiters, next.waiters...)
+}
+
+// 家電ごとの送信待ちコマンド
+type applianceQueue struct {
+	pending   []*command
+	running   bool
+	lastGroup string
+	lastSent  time.Time
+}
+
+// 家電ごとにコマンドを順番に送信するキュー
+// (送信中に来たコマンドは待たせ、同じ種類のものが続いた場合は最後の内容にまとめて送る)
+// 操作した HomeKit のコントローラーとの接続が切れた場合は送信を中断する
+// (終了処理中は送り切れるよう接続が切れても続け、終了処理で打ち切った場合のみ中断する)
+type commandQueue struct {
+	mu       sync.Mutex
+	debounce time.Duration
+	queues   map[string]*applianceQueue
+	wg       sync.WaitGroup
+	// 終了処理でコマンドの受付を止めたかどうか
+	closed bool
+	// 終了処理中に送信できなかったコマンド
+	failed []string
+	abort  context.Context
+	cancel context.CancelFunc
+}
+
+func newCommandQueue(debounce time.Duration) *commandQueue {
+	abort, cancel := context.WithCancel(context.Background())
+	return &commandQueue{
+		debounce: debounce,
+		queues:   map[string]*applianceQueue{},
+		abort:    abort,
+		cancel:   cancel,
+	}
+}
+
+var commands = newCommandQueue(DefaultCommandDebounce)
+
+// 同じ種類のコマンドの送信間隔を変更する関数
+func SetCommandDebounce(d time.Duration) {
+	commands.mu.Lock()
+	defer commands.mu.Unlock()
+	commands.debounce = d
+}
+
+// コマンドをキューに積み、送信が終わるまで待つ
+func (q *commandQueue) enqueue(ctx context.Context, id string, cmd *command) error {
+	done := make(chan error, 1)
+	cmd.ctx = ctx
+	cmd.waiters = []chan error{done}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrShuttingDown, cmd)
+	}
+	aq, found := q.queues[id]
+	if !found {
+		aq = &applianceQueue{}
+		q.queues[id] = aq
+	}
+	if n := len(aq.pending); n > 0 && cmd.group != "" && aq.pending[n-1].group == cmd.group {
+		aq.pending[n-1].merge(cmd)
+	} else {
+		aq.pending = append(aq.pending, cmd)
+	}
+	if !aq.running {
+		aq.running = true
+		q.wg.Add(1)
+		go q.run(aq)
+	}
+	q.mu.Unlock()
+
+	return <-done
+}
+
+func (q *commandQueue) run(aq *applianceQueue) {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		if len(aq.pending) == 0 {
+			aq.running = false
+			q.mu.Unlock()
+			return
+		}
+
+		// 同じ種類のコマンドが続く場合は、後続の操作をまとめられるよう少し間を空ける
+		// (終了処理中はこれ以上まとまらないため待たない)
+		cmd := aq.pending[0]
+		if cmd.group != "" && cmd.group == aq.lastGroup && !q.closed {
+			if wait := q.debounce - time.Since(aq.lastSent); wait > 0 {
+				q.mu.Unlock()
+				time.Sleep(wait)
+				continue
+			}
+		}
+		aq.pending = aq.pending[1:]
+		draining := q.closed
+		q.mu.Unlock()
+
+		parent := cmd.ctx
+		if draining {
+			parent = context.WithoutCancel(cmd.ctx)
+		}
+		ctx, cancel := context.WithCancel(parent)
+		stop := context.AfterFunc(q.abort, cancel)
+		err := cmd.send(ctx, cmd)
+		stop()
+		cancel()
+
+		q.mu.Lock()
+		aq.lastGroup = cmd.group
+		aq.lastSent = time.Now()
+		if err != nil && q.closed {
+			q.failed = append(q.failed, fmt.Sprintf("%s (%s)", cmd, err))
+		}
+		q.mu.Unlock()
+
+		for _, w := range cmd.waiters {
+			w <- err
+		}
+	}
+}
+
+// コマンドの受付を止め、送信待ちのコマンドを送り切るまで待つ関数
+// ctx が終わった時点で送信中のものは中断し、送信待ちのものは破棄する
+// (送信できなかったコマンドの一覧を返す)
+func DrainCommands(ctx context.Context) []string {
+	return commands.drain(ctx)
+}
+
+// 終了処理に入り、コマンドの受付を止めているかどうか
+func ShuttingDown() bool {
+	return commands.shuttingDown()
+}
+
+func (q *commandQueue) shuttingDown() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+func (q *commandQueue) drain(ctx context.Context) []string {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		q.mu.Lock()
+		for _, aq := range q.queues {
+			for _, cmd := range aq.pending {
+				q.failed = append(q.failed, fmt.Sprintf("%s (%s)", cmd, ctx.Err()))
+				for _, w := range cmd.waiters {
+					w <- fmt.Errorf("%w: %s", ErrShuttingDown, cmd)
+				}
+			}
+			aq.pending = nil
+		}
+		q.mu.Unlock()
+		q.cancel()
+		<-idle
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failed
+}
@@ -0,0 +1,205 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+)
+
+// HomeKit のリクエストがキャンセルされた場合は送信を中断する
+func TestCommandQueueRequestCanceled(t *testing.T) {
+	q := newCommandQueue(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := q.enqueue(ctx, "appliance", &command{name: "light", send: func(ctx context.Context, _ *command) error {
+		return ctx.Err()
+	}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+// 終了処理中は、リクエストがキャンセルされても送り切る
+func TestCommandQueueDrainDetachesRequest(t *testing.T) {
+	q := newCommandQueue(0)
+	started, release := make(chan struct{}), make(chan struct{})
+	send := func(ctx context.Context, _ *command) error {
+		<-release
+		return ctx.Err()
+	}
+
+	// 1つ目の送信中に2つ目を積み、送信待ちのまま終了処理に入る
+	first := make(chan error, 1)
+	go func() {
+		first <- q.enqueue(context.Background(), "appliance", &command{name: "first", send: func(ctx context.Context, c *command) error {
+			close(started)
+			return send(ctx, c)
+		}})
+	}()
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	second := make(chan error, 1)
+	go func() {
+		second <- q.enqueue(ctx, "appliance", &command{name: "second", send: send})
+	}()
+	waitPending(t, q, "appliance", 1)
+
+	drained := make(chan []string, 1)
+	go func() {
+		drained <- q.drain(context.Background())
+	}()
+	waitClosed(t, q)
+	cancel()
+	close(release)
+
+	if err := <-first; err != nil {
+		t.Errorf("first: %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("second: %v", err)
+	}
+	if failed := <-drained; len(failed) != 0 {
+		t.Errorf("failed = %v, want none", failed)
+	}
+}
+
+// 終了処理に入ると、受付を止めたことがわかる
+func TestCommandQueueShuttingDown(t *testing.T) {
+	q := newCommandQueue(0)
+	if q.shuttingDown() {
+		t.Fatal("shuttingDown = true before drain")
+	}
+	q.drain(context.Background())
+	if !q.shuttingDown() {
+		t.Error("shuttingDown = false after drain")
+	}
+	err := q.enqueue(context.Background(), "appliance", &command{name: "light", send: func(context.Context, *command) error { return nil }})
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("err = %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+// 送信中に来た同じ種類のコマンドは1つにまとめ、待っていた全員に結果を返す
+func TestCommandQueueMerge(t *testing.T) {
+	q := newCommandQueue(0)
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var sent []natureremo.AirConSettings
+	send := func(_ context.Context, c *command) error {
+		mu.Lock()
+		sent = append(sent, *c.aircon)
+		mu.Unlock()
+		return nil
+	}
+
+	first := make(chan error, 1)
+	go func() {
+		first <- q.enqueue(context.Background(), "aircon", &command{name: "first", group: "aircon", aircon: &natureremo.AirConSettings{Temperature: "24"}, send: func(ctx context.Context, c *command) error {
+			close(started)
+			<-release
+			return send(ctx, c)
+		}})
+	}()
+	<-started
+
+	waiters := make(chan error, 2)
+	go func() {
+		waiters <- q.enqueue(context.Background(), "aircon", &command{name: "second", group: "aircon", aircon: &natureremo.AirConSettings{Temperature: "25", OperationMode: natureremo.OperationModeCool}, send: send})
+	}()
+	waitPending(t, q, "aircon", 1)
+	go func() {
+		waiters <- q.enqueue(context.Background(), "aircon", &command{name: "third", group: "aircon", aircon: &natureremo.AirConSettings{Temperature: "26", Button: natureremo.ButtonPowerOff}, send: send})
+	}()
+	waitWaiters(t, q, "aircon", 2)
+	close(release)
+
+	if err := <-first; err != nil {
+		t.Errorf("first: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-waiters; err != nil {
+			t.Errorf("merged: %v", err)
+		}
+	}
+	want := []natureremo.AirConSettings{
+		{Temperature: "24"},
+		{Temperature: "26", OperationMode: natureremo.OperationModeCool, Button: natureremo.ButtonPowerOff},
+	}
+	if len(sent) != len(want) {
+		t.Fatalf("sent = %+v, want %+v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("sent[%d] = %+v, want %+v", i, sent[i], want[i])
+		}
+	}
+}
+
+// 同じ種類のコマンドが続く場合は送信間隔を空け、別の種類のコマンドは待たせない
+func TestCommandQueueDebounce(t *testing.T) {
+	const debounce = 100 * time.Millisecond
+	q := newCommandQueue(debounce)
+	send := func(context.Context, *command) error { return nil }
+
+	enqueue := func(group string) time.Duration {
+		start := time.Now()
+		if err := q.enqueue(context.Background(), "appliance", &command{name: group, group: group, send: send}); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	enqueue("light")
+	if elapsed := enqueue("light"); elapsed < debounce/2 {
+		t.Errorf("same group was sent after %s, want about %s", elapsed, debounce)
+	}
+	if elapsed := enqueue("fan"); elapsed >= debounce/2 {
+		t.Errorf("other group was sent after %s, want no wait", elapsed)
+	}
+}
+
+func waitPending(t *testing.T, q *commandQueue, id string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		aq, found := q.queues[id]
+		pending := found && len(aq.pending) == n
+		q.mu.Unlock()
+		if pending {
+			return
+		}
+	}
+	t.Fatalf("%d command(s) were not queued", n)
+}
+
+func waitClosed(t *testing.T, q *commandQueue) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+	t.Fatal("queue was not closed")
+}
+
+func waitWaiters(t *testing.T, q *commandQueue, id string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		q.mu.Lock()
+		aq, found := q.queues[id]
+		waiting := found && len(aq.pending) == 1 && len(aq.pending[0].waiters) == n
+		q.mu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatalf("%d command(s) were not merged", n)
+}
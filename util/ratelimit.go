@@ -0,0 +1,186 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tenntenn/natureremo"
+)
+
+// Nature API へのリクエストの優先度
+type Priority int
+
+const (
+	// 状態取得などのバックグラウンドの読み取り
+	PriorityRead Priority = iota
+	// ユーザーが Home アプリから行った操作
+	PriorityCommand
+)
+
+// 読み取りリクエストを行うことで、ユーザー操作用に残しているリクエスト枠を使ってしまう場合のエラー
+var ErrQuotaReserved = errors.New("nature api quota is reserved for user commands")
+
+// 1回の状態更新で使うリクエスト数(Devices/Appliances)
+const requestsPerRefresh = 2
+
+// Nature API の制限がリセットされるまでの期間(ヘッダが取れなかった場合に使う)
+const rateLimitWindow = 5 * time.Minute
+
+type priorityKey struct{}
+
+// リクエストの優先度を context に設定する関数
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityRead
+}
+
+// Nature API のリクエスト残量を追跡する http.RoundTripper
+// (残量が Reserve 以下になったら読み取りを止め、ユーザー操作を優先する)
+type RateLimiter struct {
+	// 実際に通信を行う RoundTripper (nil の場合は http.DefaultTransport)
+	Transport http.RoundTripper
+	// 読み取りを止めてユーザー操作用に残しておくリクエスト数
+	Reserve int64
+
+	mu        sync.Mutex
+	known     bool
+	limit     int64
+	remaining int64
+	reset     time.Time
+	throttled bool
+	log       *logrus.Entry
+}
+
+func NewRateLimiter(reserve int64) *RateLimiter {
+	log := Logger(ComponentAPI)
+	return &RateLimiter{
+		Reserve: reserve,
+		log:     log,
+	}
+}
+
+var quota *RateLimiter
+
+// リクエスト制限を考慮した Nature API クライアントを作る関数
+func NewClient(token string, reserve int64) *CloudClient {
+	quota = NewRateLimiter(reserve)
+	nr := natureremo.NewClient(token)
+	c := &CloudClient{Client: nr, limiter: quota}
+	c.token.Store(token)
+	nr.HTTPClient = &http.Client{Transport: &tokenTransport{client: c, next: quota}}
+	return c
+}
+
+// ユーザー操作用に残しておくリクエスト数を変更する
+func (l *RateLimiter) SetReserve(reserve int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Reserve = reserve
+}
+
+func (l *RateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if priorityFrom(req.Context()) == PriorityRead && !l.allowRead() {
+		return nil, ErrQuotaReserved
+	}
+
+	transport := l.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	l.update(resp)
+	return resp, nil
+}
+
+func (l *RateLimiter) allowRead() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.known || time.Now().After(l.reset) {
+		return true
+	}
+	return l.remaining > l.Reserve
+}
+
+// レスポンスヘッダからリクエスト残量を更新する
+func (l *RateLimiter) update(resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rl, err := natureremo.RateLimitFromHeader(resp.Header); err == nil {
+		l.known = true
+		l.limit = rl.Limit
+		l.remaining = rl.Remaining
+		l.reset = rl.Reset
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		l.known = true
+		l.remaining = 0
+		l.reset = time.Now().Add(rateLimitWindow)
+	} else {
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		l.remaining = 0
+	}
+
+	l.log.Debugf("Nature API quota: %d/%d (reset at %s)", l.remaining, l.limit, l.reset.Format(time.TimeOnly))
+	if !l.throttled && l.remaining <= l.Reserve {
+		l.throttled = true
+		l.log.Warnf("Nature API quota is running low(%d/%d). Background reads are paused until %s", l.remaining, l.limit, l.reset.Format(time.TimeOnly))
+	} else if l.throttled && l.remaining > l.Reserve {
+		l.throttled = false
+		l.log.Infof("Nature API quota recovered: %d/%d", l.remaining, l.limit)
+	}
+}
+
+// 残りのリクエスト数でリセットまでの時間を賄えるよう、状態取得の間隔を引き延ばす
+func (l *RateLimiter) PollInterval(base time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	untilReset := time.Until(l.reset)
+	if !l.known || untilReset <= 0 {
+		return base
+	}
+	budget := l.remaining - l.Reserve
+	if budget <= 0 {
+		return untilReset
+	}
+	if interval := untilReset * requestsPerRefresh / time.Duration(budget); interval > base {
+		return interval
+	}
+	return base
+}
+
+// 現在のリクエスト残量(まだレスポンスを受け取っていない場合は ok=false)
+func (l *RateLimiter) Quota() (remaining, limit int64, reset time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.remaining, l.limit, l.reset, l.known
+}
+
+// ユーザー操作用に残しておくリクエスト数を変更する関数
+func SetRateLimitReserve(reserve int64) {
+	if quota != nil {
+		quota.SetReserve(reserve)
+	}
+}
+
+func pollInterval(base time.Duration) time.Duration {
+	if quota == nil {
+		return base
+	}
+	return quota.PollInterval(base)
+}
@@ -0,0 +1,133 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// 指定したリクエスト残量のヘッダを返す RoundTripper
+func quotaTransport(status int, remaining int64, reset time.Time) http.RoundTripper {
+	return roundTripFunc(func(*http.Request) (*http.Response, error) {
+		h := http.Header{}
+		if remaining >= 0 {
+			h.Set("X-Rate-Limit-Limit", "30")
+			h.Set("X-Rate-Limit-Remaining", strconv.FormatInt(remaining, 10))
+			h.Set("X-Rate-Limit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		}
+		return &http.Response{StatusCode: status, Header: h, Body: http.NoBody}, nil
+	})
+}
+
+func roundTrip(t *testing.T, l *RateLimiter, p Priority) error {
+	t.Helper()
+	req, err := http.NewRequestWithContext(WithPriority(context.Background(), p), http.MethodGet, "https://api.nature.global/1/devices", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := l.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// レスポンスヘッダから残量を読み取り、Reserve 以下になったら読み取りだけを止める
+func TestRateLimiterReserve(t *testing.T) {
+	reset := time.Now().Add(time.Minute)
+	l := NewRateLimiter(5)
+
+	if _, _, _, ok := l.Quota(); ok {
+		t.Fatal("quota is known before any response")
+	}
+	l.Transport = quotaTransport(http.StatusOK, 6, reset)
+	if err := roundTrip(t, l, PriorityRead); err != nil {
+		t.Fatal(err)
+	}
+	remaining, limit, gotReset, ok := l.Quota()
+	if !ok || remaining != 6 || limit != 30 || gotReset.Unix() != reset.Unix() {
+		t.Errorf("quota = %d/%d reset %s(%t), want 6/30 reset %s", remaining, limit, gotReset, ok, reset)
+	}
+
+	l.Transport = quotaTransport(http.StatusOK, 5, reset)
+	if err := roundTrip(t, l, PriorityRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(t, l, PriorityRead); !errors.Is(err, ErrQuotaReserved) {
+		t.Errorf("read err = %v, want %v", err, ErrQuotaReserved)
+	}
+	if err := roundTrip(t, l, PriorityCommand); err != nil {
+		t.Errorf("command err = %v, want nil", err)
+	}
+
+	// Reserve を減らせば読み取りを再開する
+	l.SetReserve(2)
+	if err := roundTrip(t, l, PriorityRead); err != nil {
+		t.Errorf("read after SetReserve err = %v, want nil", err)
+	}
+}
+
+// ヘッダのない 429 は、残量なしとして制限の期間だけ読み取りを止める
+func TestRateLimiterTooManyRequests(t *testing.T) {
+	l := NewRateLimiter(0)
+	l.Transport = quotaTransport(http.StatusTooManyRequests, -1, time.Time{})
+	if err := roundTrip(t, l, PriorityCommand); err != nil {
+		t.Fatal(err)
+	}
+	remaining, _, reset, ok := l.Quota()
+	if !ok || remaining != 0 {
+		t.Errorf("quota = %d(%t), want 0", remaining, ok)
+	}
+	if until := time.Until(reset); until <= rateLimitWindow-time.Minute || until > rateLimitWindow {
+		t.Errorf("reset in %s, want about %s", until, rateLimitWindow)
+	}
+	if err := roundTrip(t, l, PriorityRead); !errors.Is(err, ErrQuotaReserved) {
+		t.Errorf("read err = %v, want %v", err, ErrQuotaReserved)
+	}
+
+	// ヘッダ付きの 429 も残量なしとして扱う
+	l.Transport = quotaTransport(http.StatusTooManyRequests, 10, time.Now().Add(time.Minute))
+	if err := roundTrip(t, l, PriorityCommand); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _, _, _ := l.Quota(); remaining != 0 {
+		t.Errorf("remaining = %d, want 0", remaining)
+	}
+}
+
+func TestRateLimiterPollInterval(t *testing.T) {
+	base := 30 * time.Second
+	tests := []struct {
+		name      string
+		known     bool
+		remaining int64
+		reset     time.Duration
+		want      time.Duration
+	}{
+		{name: "unknown", want: base},
+		{name: "after reset", known: true, remaining: 0, reset: -time.Minute, want: base},
+		{name: "plenty of budget", known: true, remaining: 105, reset: 5 * time.Minute, want: base},
+		// 残り 10 回で 5 分を賄うには 1 分ごと(1回の更新で 2 リクエスト)
+		{name: "stretched", known: true, remaining: 15, reset: 5 * time.Minute, want: time.Minute},
+		{name: "no budget", known: true, remaining: 5, reset: 5 * time.Minute, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(5)
+			l.known = tt.known
+			l.remaining = tt.remaining
+			l.reset = time.Now().Add(tt.reset)
+			// リセットまでの時間は呼び出しまでにわずかに減る
+			if got := l.PollInterval(base); got > tt.want || got < tt.want-time.Second {
+				t.Errorf("PollInterval = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tenntenn/natureremo"
+)
+
+const (
+	// Nature API 1リクエストあたりのデフォルトのタイムアウト
+	DefaultAPITimeout = 10 * time.Second
+	// 失敗した場合のデフォルトのリトライ回数
+	DefaultAPIRetries = 3
+	// リトライ間隔の基準値(試行ごとに倍になる)
+	retryBaseDelay = 500 * time.Millisecond
+)
+
+// (設定の再読み込みで、API を呼び出している最中に変わることがある)
+var (
+	apiTimeout atomic.Int64
+	apiRetries atomic.Int64
+)
+
+func init() {
+	SetAPITimeout(DefaultAPITimeout)
+	SetAPIRetries(DefaultAPIRetries)
+}
+
+// Nature API 1リクエストあたりのタイムアウトを変更する関数
+func SetAPITimeout(d time.Duration) {
+	apiTimeout.Store(int64(d))
+}
+
+// Nature API が失敗した場合のリトライ回数を変更する関数
+func SetAPIRetries(n int) {
+	apiRetries.Store(int64(n))
+}
+
+// HAP リクエストの context を返す関数(リクエストがない場合は context.Background)
+func RequestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// fn をタイムアウト付きで呼び出し、冪等な操作であれば一時的な失敗の場合にリトライする
+// (リトライ間隔は指数関数的に伸ばし、同時に失敗したリクエストが揃わないよう揺らぎを加える)
+func callAPI(ctx context.Context, name string, idempotent bool, fn func(context.Context) error) error {
+
+	log := Logger(ComponentAPI).WithField("call", name)
+
+	timeout, retries := time.Duration(apiTimeout.Load()), int(apiRetries.Load())
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := fn(callCtx)
+		cancel()
+
+		if err == nil || !idempotent || attempt >= retries || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		delay := retryBaseDelay << attempt
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Warnf("%s failed(%d/%d), retrying in %s: %s", name, attempt+1, retries, delay.Round(time.Millisecond), err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// 時間をおいて再送すれば成功する可能性があるエラーかどうか
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrQuotaReserved) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *natureremo.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatus >= http.StatusInternalServerError
+	}
+	// タイムアウトやネットワークエラー
+	return true
+}
@@ -0,0 +1,55 @@
+package util_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/legnoh/hap-nature-remo/naturefake"
+	"github.com/legnoh/hap-nature-remo/util"
+	"github.com/tenntenn/natureremo"
+)
+
+// 取得のたびに呼ばれた回数を数え、サーバーエラーを返すクライアント
+type failingClient struct {
+	*naturefake.Client
+	calls  atomic.Int32
+	onCall func()
+}
+
+func (c *failingClient) GetDevices(ctx context.Context) ([]*natureremo.Device, error) {
+	c.calls.Add(1)
+	c.onCall()
+	return nil, &natureremo.APIError{HTTPStatus: http.StatusInternalServerError, Message: "Internal Server Error"}
+}
+
+// 呼び出し中に別の goroutine で設定を読み込み直しても、その呼び出しは開始時のリトライ回数で終わる
+func TestCallAPIWhileReloading(t *testing.T) {
+	nr := &failingClient{Client: &naturefake.Client{}}
+	resetHealth(t, nr.Client)
+	t.Cleanup(func() {
+		util.SetAPITimeout(util.DefaultAPITimeout)
+		util.SetAPIRetries(util.DefaultAPIRetries)
+	})
+
+	util.SetAPIRetries(1)
+	var reloaded sync.WaitGroup
+	nr.onCall = func() {
+		reloaded.Add(1)
+		go func() {
+			defer reloaded.Done()
+			util.SetAPITimeout(time.Second)
+			util.SetAPIRetries(5)
+		}()
+	}
+	defer reloaded.Wait()
+	if got := util.GetDevices(context.Background(), nr); got.Err == nil {
+		t.Fatal("GetDevices succeeded, want error")
+	}
+	if got := nr.calls.Load(); got != 2 {
+		t.Errorf("calls = %d, want 2", got)
+	}
+}